@@ -1,9 +1,20 @@
 package main
 
 import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"math"
 	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
 // LSTM represents a key-value store that uses an in-memory database.
@@ -11,10 +22,10 @@ type LSTM struct {
 	MemDB *MemDB
 }
 
-// Set sets the value for the given key in the LSTM's MemDB.
+// Set sets the value for the given key in the LSTM's MemDB. It returns once
+// the write is as durable as the WAL sync policy requires.
 func (l *LSTM) Set(key, value string) error {
-	l.MemDB.Set(key, value)
-	return nil
+	return l.MemDB.Set(key, value)
 }
 
 // Get gets the value for the given key from the LSTM's MemDB.
@@ -36,40 +47,172 @@ func (l *LSTM) Del(key string) (string, error) {
 	return val, nil
 }
 
+// Write applies a batch of writes to the LSTM's MemDB, all or nothing.
+func (l *LSTM) Write(batch *WriteBatch) error {
+	return l.MemDB.Write(batch)
+}
+
+// NewIterator returns an iterator over the keys of the LSTM's MemDB.
+func (l *LSTM) NewIterator(opts IteratorOptions) *Iterator {
+	return l.MemDB.NewIterator(opts)
+}
+
+// Snapshot takes a snapshot of the LSTM's MemDB.
+func (l *LSTM) Snapshot() *Snapshot {
+	return l.MemDB.Snapshot()
+}
+
+// Begin starts a transaction on the LSTM's MemDB.
+func (l *LSTM) Begin() *Txn {
+	return l.MemDB.Begin()
+}
+
+// GetEntry gets the value for the given key from the LSTM's MemDB, with its
+// version and expiry time.
+func (l *LSTM) GetEntry(key string) (ValueMarkerPair, error) {
+	return l.MemDB.GetEntry(key)
+}
+
+// SetWithTTL sets the value for the given key in the LSTM's MemDB for ttl.
+func (l *LSTM) SetWithTTL(key, value string, ttl time.Duration) error {
+	return l.MemDB.SetWithTTL(key, value, ttl)
+}
+
+// WriteIf applies a batch to the LSTM's MemDB if cond holds for the given
+// key, and returns the new version of the key.
+func (l *LSTM) WriteIf(key string, batch *WriteBatch, cond Condition) (uint64, bool, error) {
+	return l.MemDB.WriteIf(key, batch, cond)
+}
+
+// DelIf deletes the given key from the LSTM's MemDB if cond holds.
+func (l *LSTM) DelIf(key string, cond Condition) (bool, error) {
+	return l.MemDB.DelIf(key, cond)
+}
+
 type Handler struct {
 	db DB
+
+	txnsMu         sync.Mutex
+	txns           map[string]*txnSession // Open /txn transactions by id
+	maxTxns        int                    // Open transactions allowed, defaultMaxTxns if zero
+	txnIdleTimeout time.Duration          // defaultTxnIdleTimeout if zero
+}
+
+// A /txn transaction is rolled back once it has not been used for
+// defaultTxnIdleTimeout, and at most defaultMaxTxns are open at once.
+const (
+	defaultTxnIdleTimeout = time.Minute
+	defaultMaxTxns        = 1024
+)
+
+// errTooManyTxns is returned by beginTxn while the most transactions
+// allowed are open.
+var errTooManyTxns = errors.New("Too many open transactions")
+
+// txnSession is a transaction opened by /txn. mu serializes the requests
+// that use it.
+type txnSession struct {
+	mu       sync.Mutex
+	txn      *Txn
+	lastUsed time.Time   // Guarded by Handler.txnsMu
+	timer    *time.Timer // Rolls the transaction back once it is idle
 }
 
+// GetHandler returns the value of a key, with its version as the ETag and,
+// for a key that expires, the seconds it has left, rounded up, in the
+// X-Remaining-TTL header. A request whose If-None-Match header holds the
+// ETag gets 304 Not Modified.
 func (h *Handler) GetHandler(w http.ResponseWriter, r *http.Request) {
 	key := r.URL.Query().Get("key")
-	value, err := h.db.Get(key)
+	entry, err := h.db.GetEntry(key)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	value, version := entry.Value, entry.Seq
+	w.Header().Set("ETag", formatETag(version))
+	if entry.ExpiresAt != 0 {
+		remaining := time.Until(time.Unix(0, entry.ExpiresAt))
+		seconds := max(int64((remaining+time.Second-1)/time.Second), 0)
+		w.Header().Set("X-Remaining-TTL", strconv.FormatInt(seconds, 10))
+	}
+	if header := r.Header.Values("If-None-Match"); len(header) > 0 {
+		tags, err := parseETags(header)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if tags.match(version, true) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
 	fmt.Fprint(w, value)
 }
 
+// SetHandler sets a key from a JSON body {"key": ..., "value": ...}, with
+// an optional "ttl_seconds" after which the key expires.
 func (h *Handler) SetHandler(w http.ResponseWriter, r *http.Request) {
-	var data map[string]string
+	var data struct {
+		Key        *string `json:"key"`
+		Value      *string `json:"value"`
+		TTLSeconds *int64  `json:"ttl_seconds"`
+	}
 	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	key, ok := data["key"]
-	if !ok {
+	if data.Key == nil {
 		http.Error(w, "Key is required in the JSON body", http.StatusBadRequest)
 		return
 	}
+	key := *data.Key
 
-	value, ok := data["value"]
-	if !ok {
+	if data.Value == nil {
 		http.Error(w, "Value is required in the JSON body", http.StatusBadRequest)
 		return
 	}
+	value := *data.Value
 
-	if err := h.db.Set(key, value); err != nil {
+	var ttl time.Duration
+	if data.TTLSeconds != nil {
+		if *data.TTLSeconds <= 0 || *data.TTLSeconds > math.MaxInt64/int64(time.Second) {
+			http.Error(w, "ttl_seconds must be a positive number of seconds", http.StatusBadRequest)
+			return
+		}
+		ttl = time.Duration(*data.TTLSeconds) * time.Second
+		if _, ok := expiryAfter(time.Now(), ttl); !ok {
+			http.Error(w, "ttl_seconds must expire before the year 2262", http.StatusBadRequest)
+			return
+		}
+	}
+
+	cond, err := preconditions(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	switch {
+	case cond != nil:
+		batch := NewWriteBatch()
+		batch.SetWithTTL(key, value, ttl)
+		var version uint64
+		var ok bool
+		version, ok, err = h.db.WriteIf(key, batch, cond)
+		if err == nil && !ok {
+			http.Error(w, "Precondition failed", http.StatusPreconditionFailed)
+			return
+		}
+		if ok {
+			w.Header().Set("ETag", formatETag(version))
+		}
+	case ttl > 0:
+		err = h.db.SetWithTTL(key, value, ttl)
+	default:
+		err = h.db.Set(key, value)
+	}
+	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
@@ -79,6 +222,33 @@ func (h *Handler) SetHandler(w http.ResponseWriter, r *http.Request) {
 
 func (h *Handler) DelHandler(w http.ResponseWriter, r *http.Request) {
 	key := r.URL.Query().Get("key")
+	cond, err := preconditions(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if cond != nil {
+		// Return the value that was deleted, as an unconditional delete does
+		var value string
+		batch := NewWriteBatch()
+		batch.Del(key)
+		version, ok, err := h.db.WriteIf(key, batch, func(current string, version uint64, exists bool) bool {
+			value = current
+			return cond(current, version, exists)
+		})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !ok {
+			http.Error(w, "Precondition failed", http.StatusPreconditionFailed)
+			return
+		}
+		w.Header().Set("ETag", formatETag(version))
+		fmt.Fprint(w, value)
+		return
+	}
+
 	value, err := h.db.Del(key)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -87,6 +257,508 @@ func (h *Handler) DelHandler(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprint(w, value)
 }
 
+// etagList is the value of an If-Match or If-None-Match header: either *,
+// which matches any existing key, or a list of versions.
+type etagList struct {
+	any      bool
+	versions []uint64
+}
+
+// formatETag returns the ETag of a version of a key.
+func formatETag(version uint64) string {
+	return `"` + strconv.FormatUint(version, 10) + `"`
+}
+
+// parseETags parses the values of an If-Match or If-None-Match header. Weak
+// ETags are compared as if they were strong.
+func parseETags(values []string) (etagList, error) {
+	var tags etagList
+	for _, value := range values {
+		for _, tag := range strings.Split(value, ",") {
+			tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+			if tag == "*" {
+				tags.any = true
+				continue
+			}
+			version, err := strconv.ParseUint(strings.Trim(tag, `"`), 10, 64)
+			if err != nil || len(tag) < 2 || tag[0] != '"' || tag[len(tag)-1] != '"' {
+				return etagList{}, fmt.Errorf("Invalid ETag %s", tag)
+			}
+			tags.versions = append(tags.versions, version)
+		}
+	}
+	return tags, nil
+}
+
+// match reports whether the list matches the given version of a key.
+func (tags etagList) match(version uint64, exists bool) bool {
+	if !exists {
+		return false
+	}
+	if tags.any {
+		return true
+	}
+	for _, v := range tags.versions {
+		if v == version {
+			return true
+		}
+	}
+	return false
+}
+
+// preconditions turns the If-Match and If-None-Match headers of a write into
+// a Condition on the current version of its key, or nil if there are none.
+// If-Match requires the key to exist with one of the versions listed, and
+// If-None-Match requires it not to: If-None-Match: * writes only a missing
+// key.
+func preconditions(r *http.Request) (Condition, error) {
+	ifMatch, ifNoneMatch := r.Header.Values("If-Match"), r.Header.Values("If-None-Match")
+	if len(ifMatch) == 0 && len(ifNoneMatch) == 0 {
+		return nil, nil
+	}
+	match, err := parseETags(ifMatch)
+	if err != nil {
+		return nil, err
+	}
+	noneMatch, err := parseETags(ifNoneMatch)
+	if err != nil {
+		return nil, err
+	}
+	return func(_ string, version uint64, exists bool) bool {
+		if len(ifMatch) > 0 && !match.match(version, exists) {
+			return false
+		}
+		return !noneMatch.match(version, exists)
+	}, nil
+}
+
+// Scan pages hold at most maxScanLimit keys, defaultScanLimit if no limit
+// is given.
+const (
+	defaultScanLimit = 100
+	maxScanLimit     = 1000
+)
+
+// scanItem is a key-value pair returned by /scan.
+type scanItem struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// ScanHandler lists keys in order. The range is given by start (inclusive),
+// end (exclusive) and prefix, all optional, and reverse=true lists it from
+// the end. A page holds up to limit keys. When more keys follow, the
+// X-Continuation-Token header, and the next field of a JSON response, hold
+// a token to pass back as token with the same parameters for the next page.
+// The token names the last key returned, so the next page resumes right
+// after it whatever was written in between. format=ndjson returns one JSON
+// object per line instead of a JSON object.
+func (h *Handler) ScanHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	opts := IteratorOptions{LowerBound: query.Get("start"), UpperBound: query.Get("end")}
+	if prefix := query.Get("prefix"); prefix != "" {
+		if prefix > opts.LowerBound {
+			opts.LowerBound = prefix
+		}
+		if end := prefixEnd(prefix); end != "" && (opts.UpperBound == "" || end < opts.UpperBound) {
+			opts.UpperBound = end
+		}
+	}
+
+	limit := defaultScanLimit
+	if value := query.Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 || n > maxScanLimit {
+			http.Error(w, fmt.Sprintf("limit must be between 1 and %d", maxScanLimit), http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	reverse := query.Get("reverse") == "true"
+	format := query.Get("format")
+	if format != "" && format != "json" && format != "ndjson" {
+		http.Error(w, "format must be json or ndjson", http.StatusBadRequest)
+		return
+	}
+
+	// Resume after the last key of the previous page
+	if token := query.Get("token"); token != "" {
+		last, err := base64.RawURLEncoding.DecodeString(token)
+		if err != nil {
+			http.Error(w, "Invalid continuation token", http.StatusBadRequest)
+			return
+		}
+		if reverse {
+			if opts.UpperBound == "" || string(last) < opts.UpperBound {
+				opts.UpperBound = string(last)
+			}
+		} else if next := string(last) + "\x00"; next > opts.LowerBound {
+			opts.LowerBound = next
+		}
+	}
+
+	it := h.db.NewIterator(opts)
+	defer it.Close()
+	items := make([]scanItem, 0, limit)
+	if reverse {
+		for it.SeekToLast(); it.Valid() && len(items) < limit; it.Prev() {
+			items = append(items, scanItem{Key: it.Key(), Value: it.Value()})
+		}
+	} else {
+		for it.SeekToFirst(); it.Valid() && len(items) < limit; it.Next() {
+			items = append(items, scanItem{Key: it.Key(), Value: it.Value()})
+		}
+	}
+	if err := it.Error(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var next string
+	if it.Valid() {
+		next = base64.RawURLEncoding.EncodeToString([]byte(items[len(items)-1].Key))
+		w.Header().Set("X-Continuation-Token", next)
+	}
+
+	if format == "ndjson" {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		encoder := json.NewEncoder(w)
+		for _, item := range items {
+			encoder.Encode(item)
+		}
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Items []scanItem `json:"items"`
+		Next  string     `json:"next,omitempty"`
+	}{items, next})
+}
+
+// A /batch request holds at most maxBatchOps operations, and a /mget request
+// at most maxBatchOps keys.
+const maxBatchOps = 1000
+
+// batchOp is an operation of a /batch request: a set, a del or a get.
+type batchOp struct {
+	Op    string  `json:"op"`
+	Key   *string `json:"key"`
+	Value *string `json:"value"`
+}
+
+// keyResult is the outcome of an operation of /batch or of a key of /mget.
+// Value is only set for a get that found the key, and Error for one that
+// did not.
+type keyResult struct {
+	Op    string  `json:"op,omitempty"`
+	Key   string  `json:"key"`
+	Value *string `json:"value,omitempty"`
+	Error string  `json:"error,omitempty"`
+}
+
+// BatchHandler runs a JSON array of operations, each {"op": "set", "key":
+// ..., "value": ...}, {"op": "del", "key": ...} or {"op": "get", "key":
+// ...}, and returns a JSON array with the result of each, in order. The sets
+// and dels are written atomically as one WriteBatch, and a del of a missing
+// key is not an error. A get sees the store as it was when the request
+// started, with the earlier sets and dels of the request applied. Nothing is
+// written if any operation is invalid.
+func (h *Handler) BatchHandler(w http.ResponseWriter, r *http.Request) {
+	ops, ok := decodeBatchOps(w, r)
+	if !ok {
+		return
+	}
+
+	snap := h.db.Snapshot()
+	defer snap.Release()
+
+	// Gets read the writes of the request on top of the snapshot, a nil
+	// value standing for a del
+	batch := NewWriteBatch()
+	written := make(map[string]*string)
+	results := make([]keyResult, len(ops))
+	for i, op := range ops {
+		key := *op.Key
+		results[i] = keyResult{Op: op.Op, Key: key}
+		switch op.Op {
+		case "set":
+			batch.Set(key, *op.Value)
+			written[key] = op.Value
+		case "del":
+			batch.Del(key)
+			written[key] = nil
+		case "get":
+			if value, ok := written[key]; ok {
+				if value == nil {
+					results[i].Error = "Key not found"
+				} else {
+					results[i].Value = value
+				}
+				continue
+			}
+			value, err := snap.Get(key)
+			if err != nil {
+				results[i].Error = err.Error()
+				continue
+			}
+			results[i].Value = &value
+		}
+	}
+
+	if err := h.db.Write(batch); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(results)
+}
+
+// decodeBatchOps reads the operations of a /batch or /txn request. If they
+// are invalid it replies with an error and returns false.
+func decodeBatchOps(w http.ResponseWriter, r *http.Request) ([]batchOp, bool) {
+	var ops []batchOp
+	if err := json.NewDecoder(r.Body).Decode(&ops); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+	if len(ops) > maxBatchOps {
+		http.Error(w, fmt.Sprintf("A batch holds at most %d operations", maxBatchOps), http.StatusBadRequest)
+		return nil, false
+	}
+	for i, op := range ops {
+		if op.Op != "set" && op.Op != "del" && op.Op != "get" {
+			http.Error(w, fmt.Sprintf("Operation %d: op must be set, del or get", i), http.StatusBadRequest)
+			return nil, false
+		}
+		if op.Key == nil {
+			http.Error(w, fmt.Sprintf("Operation %d: key is required", i), http.StatusBadRequest)
+			return nil, false
+		}
+		if op.Op == "set" && op.Value == nil {
+			http.Error(w, fmt.Sprintf("Operation %d: value is required", i), http.StatusBadRequest)
+			return nil, false
+		}
+	}
+	return ops, true
+}
+
+// TxnHandler exposes transactions. A POST without an id begins one and
+// returns {"id": ...}. With id, the body is a JSON array of operations as
+// for /batch, run in the transaction: gets read its snapshot and its own
+// writes, and sets and dels are buffered. action=commit commits it, with
+// 409 Conflict if a key it read has changed since it began, and
+// action=rollback drops it. Either way the id is then no longer valid, and
+// so is the id of a transaction left unused for a minute. Beginning a
+// transaction while 1024 are open gets 503 Service Unavailable.
+func (h *Handler) TxnHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	id := query.Get("id")
+	if id == "" {
+		newID, err := h.beginTxn()
+		if err != nil {
+			code := http.StatusInternalServerError
+			if errors.Is(err, errTooManyTxns) {
+				code = http.StatusServiceUnavailable
+			}
+			http.Error(w, err.Error(), code)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"id": newID})
+		return
+	}
+
+	action := query.Get("action")
+	var ops []batchOp
+	switch action {
+	case "":
+		var ok bool
+		if ops, ok = decodeBatchOps(w, r); !ok {
+			return
+		}
+	case "commit", "rollback":
+	default:
+		http.Error(w, "action must be commit or rollback", http.StatusBadRequest)
+		return
+	}
+
+	session := h.txnSession(id, action != "")
+	if session == nil {
+		http.Error(w, "Transaction not found", http.StatusNotFound)
+		return
+	}
+	session.mu.Lock()
+	defer session.mu.Unlock()
+
+	switch action {
+	case "commit":
+		if err := session.txn.Commit(); err != nil {
+			code := http.StatusInternalServerError
+			if errors.Is(err, ErrConflict) {
+				code = http.StatusConflict
+			}
+			http.Error(w, err.Error(), code)
+		}
+		return
+	case "rollback":
+		session.txn.Rollback()
+		return
+	}
+
+	results := make([]keyResult, len(ops))
+	for i, op := range ops {
+		key := *op.Key
+		results[i] = keyResult{Op: op.Op, Key: key}
+		var err error
+		switch op.Op {
+		case "set":
+			err = session.txn.Set(key, *op.Value)
+		case "del":
+			err = session.txn.Del(key)
+		case "get":
+			var value string
+			if value, err = session.txn.Get(key); err == nil {
+				results[i].Value = &value
+			}
+		}
+		if err != nil {
+			results[i].Error = err.Error()
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(results)
+}
+
+// beginTxn begins a transaction and returns its id.
+func (h *Handler) beginTxn() (string, error) {
+	random := make([]byte, 16)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+	id := hex.EncodeToString(random)
+
+	h.txnsMu.Lock()
+	defer h.txnsMu.Unlock()
+	maxTxns := h.maxTxns
+	if maxTxns == 0 {
+		maxTxns = defaultMaxTxns
+	}
+	if len(h.txns) >= maxTxns {
+		return "", errTooManyTxns
+	}
+	if h.txns == nil {
+		h.txns = make(map[string]*txnSession)
+	}
+	session := &txnSession{txn: h.db.Begin(), lastUsed: time.Now()}
+	session.timer = time.AfterFunc(h.idleTimeout(), func() { h.expireTxn(id, session) })
+	h.txns[id] = session
+	return id, nil
+}
+
+// idleTimeout returns how long a transaction may be left unused.
+func (h *Handler) idleTimeout() time.Duration {
+	if h.txnIdleTimeout == 0 {
+		return defaultTxnIdleTimeout
+	}
+	return h.txnIdleTimeout
+}
+
+// txnSession returns the open transaction with the given id, or nil. If
+// end is set the transaction is removed, as it is about to be committed or
+// rolled back.
+func (h *Handler) txnSession(id string, end bool) *txnSession {
+	h.txnsMu.Lock()
+	defer h.txnsMu.Unlock()
+	session, ok := h.txns[id]
+	if !ok {
+		return nil
+	}
+	if end {
+		delete(h.txns, id)
+		session.timer.Stop()
+	}
+	session.lastUsed = time.Now()
+	return session
+}
+
+// expireTxn runs on the timer of a transaction. It rolls the transaction
+// back if it has been left unused for the idle timeout, and otherwise sets
+// the timer to check again once it could have been.
+func (h *Handler) expireTxn(id string, session *txnSession) {
+	h.txnsMu.Lock()
+	if h.txns[id] != session {
+		// Committed or rolled back in the meantime
+		h.txnsMu.Unlock()
+		return
+	}
+	if idle := time.Since(session.lastUsed); idle < h.idleTimeout() {
+		session.timer.Reset(h.idleTimeout() - idle)
+		h.txnsMu.Unlock()
+		return
+	}
+	delete(h.txns, id)
+	h.txnsMu.Unlock()
+
+	session.mu.Lock()
+	session.txn.Rollback()
+	session.mu.Unlock()
+}
+
+// MGetHandler gets many keys at once, given as repeated key parameters or as
+// a POST body {"keys": [...]}. It returns a JSON array with the value of
+// each key, or the error for a key it could not get, in order. Every key is
+// read from the same snapshot.
+func (h *Handler) MGetHandler(w http.ResponseWriter, r *http.Request) {
+	keys := r.URL.Query()["key"]
+	if r.Method == http.MethodPost {
+		var data struct {
+			Keys []string `json:"keys"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		keys = append(keys, data.Keys...)
+	}
+	if len(keys) > maxBatchOps {
+		http.Error(w, fmt.Sprintf("At most %d keys can be fetched at once", maxBatchOps), http.StatusBadRequest)
+		return
+	}
+
+	snap := h.db.Snapshot()
+	defer snap.Release()
+	results := make([]keyResult, len(keys))
+	for i, key := range keys {
+		results[i].Key = key
+		value, err := snap.Get(key)
+		if err != nil {
+			results[i].Error = err.Error()
+			continue
+		}
+		results[i].Value = &value
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(results)
+}
+
+// prefixEnd returns the smallest key greater than every key starting with
+// prefix, or "" if there is none.
+func prefixEnd(prefix string) string {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return string(end[:i+1])
+		}
+	}
+	return ""
+}
+
 func main() {
 	// memDB := NewMemDB()
 	// lstm := &LSTM{MemDB: memDB}
@@ -99,8 +771,17 @@ func main() {
 	// fmt.Println("Server is listening on :8080")
 	// http.ListenAndServe(":8080", nil)
 
-	// Create a new MemDB
-	memDB := NewMemDB()
+	opts := DefaultOptions()
+	flag.StringVar(&opts.Dir, "dir", opts.Dir, "directory holding the store files")
+	flag.StringVar(&opts.ListenAddr, "addr", opts.ListenAddr, "address the server listens on")
+	flag.Parse()
+
+	// Open the MemDB
+	memDB, err := Open(opts.Dir, opts)
+	if err != nil {
+		fmt.Println("Error opening store:", err)
+		os.Exit(1)
+	}
 	lstm := &LSTM{MemDB: memDB}
 	handler := &Handler{db: lstm}
 
@@ -108,11 +789,15 @@ func main() {
 	http.HandleFunc("/get", handler.GetHandler)
 	http.HandleFunc("/set", handler.SetHandler)
 	http.HandleFunc("/del", handler.DelHandler)
+	http.HandleFunc("/scan", handler.ScanHandler)
+	http.HandleFunc("/batch", handler.BatchHandler)
+	http.HandleFunc("/mget", handler.MGetHandler)
+	http.HandleFunc("/txn", handler.TxnHandler)
 
 	// Start the server in a goroutine
 	go func() {
-		fmt.Println("Server is listening on :8080")
-		err := http.ListenAndServe(":8080", nil)
+		fmt.Println("Server is listening on", opts.ListenAddr)
+		err := http.ListenAndServe(opts.ListenAddr, nil)
 		if err != nil {
 			fmt.Println("Error starting server:", err)
 		}
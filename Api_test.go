@@ -6,11 +6,16 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestAPISetGet(t *testing.T) {
-	lstm := &LSTM{MemDB: NewMemDB()}
+	lstm := &LSTM{MemDB: openTestDB(t, t.TempDir())}
 	handler := &Handler{db: lstm}
 
 	key := "testKey"
@@ -56,3 +61,548 @@ func TestAPISetGet(t *testing.T) {
 func TestAPIDel(t *testing.T) {
 	// Your API Del testing code here
 }
+
+// TestAPIConcurrentRequests hammers the handlers from many goroutines while
+// the memtable is rotated, flushed and compacted underneath. Run it with
+// -race.
+func TestAPIConcurrentRequests(t *testing.T) {
+	memDB := openTestDB(t, t.TempDir())
+	defer memDB.Close()
+	handler := &Handler{db: &LSTM{MemDB: memDB}}
+
+	set := func(key, value string) int {
+		body, _ := json.Marshal(map[string]string{"key": key, "value": value})
+		response := httptest.NewRecorder()
+		handler.SetHandler(response, httptest.NewRequest("POST", "/set", bytes.NewReader(body)))
+		return response.Code
+	}
+	get := func(key string) (int, string) {
+		response := httptest.NewRecorder()
+		handler.GetHandler(response, httptest.NewRequest("GET", "/get?key="+key, nil))
+		return response.Code, response.Body.String()
+	}
+	del := func(key string) int {
+		response := httptest.NewRecorder()
+		handler.DelHandler(response, httptest.NewRequest("DELETE", "/del?key="+key, nil))
+		return response.Code
+	}
+
+	const workers, rounds = 8, 50
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < rounds; i++ {
+				// Every worker reads its own writes back
+				key := "worker" + strconv.Itoa(w) + "-" + strconv.Itoa(i%10)
+				value := "value" + strconv.Itoa(i)
+				if code := set(key, value); code != http.StatusOK {
+					t.Errorf("Expected status code %d for set of %s, got %d", http.StatusOK, key, code)
+					return
+				}
+				if code, result := get(key); code != http.StatusOK || result != value {
+					t.Errorf("Expected %s for %s, got %q (status %d)", value, key, result, code)
+					return
+				}
+
+				// Every worker also fights over a few shared keys
+				shared := "shared" + strconv.Itoa(i%3)
+				set(shared, "from"+strconv.Itoa(w))
+				if code, result := get(shared); code == http.StatusOK && !strings.HasPrefix(result, "from") {
+					t.Errorf("Expected a value written by a worker for %s, got %q", shared, result)
+					return
+				}
+				del(shared)
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	for w := 0; w < workers; w++ {
+		for i := rounds - 10; i < rounds; i++ {
+			key := "worker" + strconv.Itoa(w) + "-" + strconv.Itoa(i%10)
+			if code, result := get(key); code != http.StatusOK || result != "value"+strconv.Itoa(i) {
+				t.Errorf("Expected value%d for %s, got %q (status %d)", i, key, result, code)
+			}
+		}
+	}
+}
+
+// scanPage calls the scan handler and returns the keys of the page and the
+// continuation token.
+func scanPage(t *testing.T, handler *Handler, query string) ([]string, string) {
+	t.Helper()
+	response := httptest.NewRecorder()
+	handler.ScanHandler(response, httptest.NewRequest("GET", "/scan?"+query, nil))
+	if response.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d for scan, got %d: %s", http.StatusOK, response.Code, response.Body.String())
+	}
+
+	var page struct {
+		Items []scanItem `json:"items"`
+		Next  string     `json:"next"`
+	}
+	if err := json.NewDecoder(response.Body).Decode(&page); err != nil {
+		t.Fatalf("Error decoding scan response: %v", err)
+	}
+	if header := response.Header().Get("X-Continuation-Token"); header != page.Next {
+		t.Errorf("Expected the token header to match %q, got %q", page.Next, header)
+	}
+	var keys []string
+	for _, item := range page.Items {
+		keys = append(keys, item.Key)
+	}
+	return keys, page.Next
+}
+
+func TestAPIScanPagination(t *testing.T) {
+	memDB := openTestDB(t, t.TempDir())
+	defer memDB.Close()
+	handler := &Handler{db: &LSTM{MemDB: memDB}}
+
+	for i := 10; i < 40; i++ {
+		if err := memDB.Set("key"+strconv.Itoa(i), "value"); err != nil {
+			t.Fatalf("Error setting key-value pair: %v", err)
+		}
+	}
+
+	// Writes between pages land before or after the cursor, and do not
+	// shift the pages
+	for _, reverse := range []string{"false", "true"} {
+		var keys []string
+		token := ""
+		for page := 0; ; page++ {
+			query := "limit=7&reverse=" + reverse
+			if token != "" {
+				query += "&token=" + token
+			}
+			var pageKeys []string
+			pageKeys, token = scanPage(t, handler, query)
+			keys = append(keys, pageKeys...)
+			if token == "" {
+				break
+			}
+			if page > 10 {
+				t.Fatal("Expected the scan to end")
+			}
+
+			memDB.Set("key"+strconv.Itoa(10+page)+"x", "value")
+			memDB.Set("key"+strconv.Itoa(39-page)+"x", "value")
+		}
+
+		seen := make(map[string]bool)
+		for i, key := range keys {
+			if seen[key] {
+				t.Errorf("Expected %s once in the %s scan", key, reverse)
+			}
+			seen[key] = true
+			if i > 0 && (keys[i-1] < key) != (reverse == "false") {
+				t.Errorf("Expected keys in order in the %s scan, got %s then %s", reverse, keys[i-1], key)
+			}
+		}
+		for i := 10; i < 40; i++ {
+			if !seen["key"+strconv.Itoa(i)] {
+				t.Errorf("Expected key%d in the %s scan", i, reverse)
+			}
+		}
+	}
+}
+
+func TestAPIScanRanges(t *testing.T) {
+	memDB := openTestDB(t, t.TempDir())
+	defer memDB.Close()
+	handler := &Handler{db: &LSTM{MemDB: memDB}}
+
+	for _, key := range []string{"apple", "apricot", "banana", "blueberry", "cherry"} {
+		if err := memDB.Set(key, "fruit"); err != nil {
+			t.Fatalf("Error setting key-value pair: %v", err)
+		}
+	}
+
+	tests := []struct {
+		query string
+		keys  []string
+	}{
+		{"prefix=ap", []string{"apple", "apricot"}},
+		{"prefix=b&reverse=true", []string{"blueberry", "banana"}},
+		{"start=apricot&end=blueberry", []string{"apricot", "banana"}},
+		{"start=b&prefix=a", nil},
+	}
+	for _, test := range tests {
+		if keys, token := scanPage(t, handler, test.query); !reflect.DeepEqual(keys, test.keys) || token != "" {
+			t.Errorf("Expected %v for %s, got %v (token %q)", test.keys, test.query, keys, token)
+		}
+	}
+
+	response := httptest.NewRecorder()
+	handler.ScanHandler(response, httptest.NewRequest("GET", "/scan?format=ndjson&limit=2", nil))
+	lines := strings.Split(strings.TrimSpace(response.Body.String()), "\n")
+	if len(lines) != 2 || lines[0] != `{"key":"apple","value":"fruit"}` || response.Header().Get("X-Continuation-Token") == "" {
+		t.Errorf("Expected two NDJSON lines and a token, got %q", response.Body.String())
+	}
+
+	response = httptest.NewRecorder()
+	handler.ScanHandler(response, httptest.NewRequest("GET", "/scan?limit=0", nil))
+	if response.Code != http.StatusBadRequest {
+		t.Errorf("Expected status code %d for a bad limit, got %d", http.StatusBadRequest, response.Code)
+	}
+}
+
+// decodeResults decodes the JSON array returned by /batch or /mget.
+func decodeResults(t *testing.T, response *httptest.ResponseRecorder) []keyResult {
+	t.Helper()
+	if response.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d: %s", http.StatusOK, response.Code, response.Body.String())
+	}
+	var results []keyResult
+	if err := json.NewDecoder(response.Body).Decode(&results); err != nil {
+		t.Fatalf("Error decoding response: %v", err)
+	}
+	return results
+}
+
+func TestAPIBatch(t *testing.T) {
+	memDB := openTestDB(t, t.TempDir())
+	defer memDB.Close()
+	handler := &Handler{db: &LSTM{MemDB: memDB}}
+
+	if err := memDB.Set("old", "value"); err != nil {
+		t.Fatalf("Error setting key-value pair: %v", err)
+	}
+
+	body := `[
+		{"op": "get", "key": "old"},
+		{"op": "set", "key": "a", "value": "1"},
+		{"op": "del", "key": "old"},
+		{"op": "get", "key": "a"},
+		{"op": "get", "key": "old"},
+		{"op": "del", "key": "missing"},
+		{"op": "set", "key": "b", "value": ""}
+	]`
+	response := httptest.NewRecorder()
+	handler.BatchHandler(response, httptest.NewRequest("POST", "/batch", strings.NewReader(body)))
+	results := decodeResults(t, response)
+
+	// Gets see the earlier writes of the batch
+	var got []string
+	for _, result := range results {
+		entry := result.Op + " " + result.Key
+		if result.Value != nil {
+			entry += "=" + *result.Value
+		}
+		if result.Error != "" {
+			entry += " !"
+		}
+		got = append(got, entry)
+	}
+	want := []string{"get old=value", "set a", "del old", "get a=1", "get old !", "del missing", "set b"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected results %v, got %v", want, got)
+	}
+	for key, value := range map[string]string{"a": "1", "b": ""} {
+		if result, err := memDB.Get(key); err != nil || result != value {
+			t.Errorf("Expected %q for %s, got %q (%v)", value, key, result, err)
+		}
+	}
+	if _, err := memDB.Get("old"); err == nil {
+		t.Error("Expected the batch to delete old")
+	}
+
+	// An invalid operation rejects the whole batch
+	before := memDB.Snapshot().Seq()
+	for _, body := range []string{
+		`[{"op": "set", "key": "c", "value": "3"}, {"op": "put", "key": "d"}]`,
+		`[{"op": "set", "key": "c"}]`,
+		`[{"op": "get"}]`,
+		`{"op": "get", "key": "a"}`,
+	} {
+		response := httptest.NewRecorder()
+		handler.BatchHandler(response, httptest.NewRequest("POST", "/batch", strings.NewReader(body)))
+		if response.Code != http.StatusBadRequest {
+			t.Errorf("Expected status code %d for %s, got %d", http.StatusBadRequest, body, response.Code)
+		}
+	}
+	if seq := memDB.Snapshot().Seq(); seq != before {
+		t.Errorf("Expected rejected batches not to write, got sequence number %d after %d", seq, before)
+	}
+}
+
+func TestAPIMGet(t *testing.T) {
+	memDB := openTestDB(t, t.TempDir())
+	defer memDB.Close()
+	handler := &Handler{db: &LSTM{MemDB: memDB}}
+
+	for _, key := range []string{"a", "b", "c"} {
+		if err := memDB.Set(key, "value-"+key); err != nil {
+			t.Fatalf("Error setting key-value pair: %v", err)
+		}
+	}
+
+	requests := []*http.Request{
+		httptest.NewRequest("GET", "/mget?key=c&key=missing&key=a", nil),
+		httptest.NewRequest("POST", "/mget", strings.NewReader(`{"keys": ["c", "missing", "a"]}`)),
+	}
+	for _, request := range requests {
+		response := httptest.NewRecorder()
+		handler.MGetHandler(response, request)
+		results := decodeResults(t, response)
+		if len(results) != 3 {
+			t.Fatalf("Expected 3 results for %s, got %+v", request.Method, results)
+		}
+		for i, key := range []string{"c", "missing", "a"} {
+			result := results[i]
+			if result.Key != key {
+				t.Errorf("Expected result %d to be for %s, got %s", i, key, result.Key)
+			}
+			if key == "missing" {
+				if result.Value != nil || result.Error == "" {
+					t.Errorf("Expected an error for the missing key, got %+v", result)
+				}
+			} else if result.Value == nil || *result.Value != "value-"+key {
+				t.Errorf("Expected value-%s for %s, got %+v", key, key, result)
+			}
+		}
+	}
+}
+
+func TestAPITxn(t *testing.T) {
+	memDB := openTestDB(t, t.TempDir())
+	defer memDB.Close()
+	handler := &Handler{db: &LSTM{MemDB: memDB}}
+
+	memDB.Set("alice", "100")
+	memDB.Set("bob", "100")
+
+	txn := func(query, body string) *httptest.ResponseRecorder {
+		response := httptest.NewRecorder()
+		handler.TxnHandler(response, httptest.NewRequest("POST", "/txn"+query, strings.NewReader(body)))
+		return response
+	}
+	begin := func() string {
+		var data struct {
+			ID string `json:"id"`
+		}
+		if err := json.NewDecoder(txn("", "").Body).Decode(&data); err != nil || data.ID == "" {
+			t.Fatalf("Error beginning transaction: %v", err)
+		}
+		return data.ID
+	}
+
+	// Two transfers read the same balances, so only the first one commits
+	first, second := begin(), begin()
+	for _, id := range []string{first, second} {
+		results := decodeResults(t, txn("?id="+id, `[{"op": "get", "key": "alice"}, {"op": "get", "key": "bob"}]`))
+		if len(results) != 2 || results[0].Value == nil || *results[0].Value != "100" {
+			t.Fatalf("Expected the balances in the transaction, got %+v", results)
+		}
+	}
+	decodeResults(t, txn("?id="+first, `[{"op": "set", "key": "alice", "value": "90"}, {"op": "set", "key": "bob", "value": "110"}]`))
+	decodeResults(t, txn("?id="+second, `[{"op": "set", "key": "alice", "value": "80"}, {"op": "set", "key": "bob", "value": "120"}]`))
+
+	if response := txn("?id="+first+"&action=commit", ""); response.Code != http.StatusOK {
+		t.Errorf("Expected status code %d for the first commit, got %d: %s", http.StatusOK, response.Code, response.Body.String())
+	}
+	if response := txn("?id="+second+"&action=commit", ""); response.Code != http.StatusConflict {
+		t.Errorf("Expected status code %d for the conflicting commit, got %d", http.StatusConflict, response.Code)
+	}
+	if value, err := memDB.Get("alice"); err != nil || value != "90" {
+		t.Errorf("Expected 90 for alice, got %q (%v)", value, err)
+	}
+
+	// Finished transactions are gone
+	if response := txn("?id="+first, `[{"op": "get", "key": "alice"}]`); response.Code != http.StatusNotFound {
+		t.Errorf("Expected status code %d for a committed transaction, got %d", http.StatusNotFound, response.Code)
+	}
+	id := begin()
+	if response := txn("?id="+id+"&action=rollback", ""); response.Code != http.StatusOK {
+		t.Errorf("Expected status code %d for a rollback, got %d", http.StatusOK, response.Code)
+	}
+	if response := txn("?id="+id+"&action=commit", ""); response.Code != http.StatusNotFound {
+		t.Errorf("Expected status code %d after a rollback, got %d", http.StatusNotFound, response.Code)
+	}
+}
+
+func TestAPITxnLimitAndExpiry(t *testing.T) {
+	memDB := openTestDB(t, t.TempDir())
+	defer memDB.Close()
+	handler := &Handler{db: &LSTM{MemDB: memDB}, maxTxns: 2, txnIdleTimeout: 50 * time.Millisecond}
+
+	begin := func() *httptest.ResponseRecorder {
+		response := httptest.NewRecorder()
+		handler.TxnHandler(response, httptest.NewRequest("POST", "/txn", nil))
+		return response
+	}
+	open := func() int {
+		handler.txnsMu.Lock()
+		defer handler.txnsMu.Unlock()
+		return len(handler.txns)
+	}
+
+	for i := 0; i < 2; i++ {
+		if response := begin(); response.Code != http.StatusOK {
+			t.Fatalf("Expected status code %d beginning a transaction, got %d", http.StatusOK, response.Code)
+		}
+	}
+	if response := begin(); response.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected status code %d beyond the limit, got %d", http.StatusServiceUnavailable, response.Code)
+	}
+
+	// Idle transactions are rolled back without another request coming in
+	deadline := time.Now().Add(5 * time.Second)
+	for open() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected idle transactions to expire, %d still open", open())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if response := begin(); response.Code != http.StatusOK {
+		t.Errorf("Expected status code %d once transactions expired, got %d", http.StatusOK, response.Code)
+	}
+}
+
+func TestAPIConditionalWrites(t *testing.T) {
+	memDB := openTestDB(t, t.TempDir())
+	defer memDB.Close()
+	handler := &Handler{db: &LSTM{MemDB: memDB}}
+
+	set := func(value string, header ...string) int {
+		body, _ := json.Marshal(map[string]string{"key": "key", "value": value})
+		request := httptest.NewRequest("POST", "/set", bytes.NewReader(body))
+		for i := 0; i < len(header); i += 2 {
+			request.Header.Set(header[i], header[i+1])
+		}
+		response := httptest.NewRecorder()
+		handler.SetHandler(response, request)
+		return response.Code
+	}
+	get := func(header ...string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest("GET", "/get?key=key", nil)
+		for i := 0; i < len(header); i += 2 {
+			request.Header.Set(header[i], header[i+1])
+		}
+		response := httptest.NewRecorder()
+		handler.GetHandler(response, request)
+		return response
+	}
+
+	if code := set("first", "If-Match", "*"); code != http.StatusPreconditionFailed {
+		t.Errorf("Expected status code %d for If-Match of a missing key, got %d", http.StatusPreconditionFailed, code)
+	}
+	if code := set("first", "If-None-Match", "*"); code != http.StatusOK {
+		t.Errorf("Expected status code %d for If-None-Match of a missing key, got %d", http.StatusOK, code)
+	}
+	if code := set("second", "If-None-Match", "*"); code != http.StatusPreconditionFailed {
+		t.Errorf("Expected status code %d for If-None-Match of an existing key, got %d", http.StatusPreconditionFailed, code)
+	}
+
+	etag := get().Header().Get("ETag")
+	if etag == "" {
+		t.Fatal("Expected an ETag")
+	}
+	if response := get("If-None-Match", etag); response.Code != http.StatusNotModified {
+		t.Errorf("Expected status code %d for an unchanged key, got %d", http.StatusNotModified, response.Code)
+	}
+
+	// Of two writers holding the same ETag, only the first one wins
+	if code := set("second", "If-Match", etag); code != http.StatusOK {
+		t.Errorf("Expected status code %d for a matching ETag, got %d", http.StatusOK, code)
+	}
+	if code := set("third", "If-Match", etag); code != http.StatusPreconditionFailed {
+		t.Errorf("Expected status code %d for a stale ETag, got %d", http.StatusPreconditionFailed, code)
+	}
+	response := get("If-None-Match", etag)
+	if response.Code != http.StatusOK || response.Body.String() != "second" || response.Header().Get("ETag") == etag {
+		t.Errorf("Expected second with a new ETag, got %q (status %d, ETag %s)", response.Body.String(), response.Code, response.Header().Get("ETag"))
+	}
+
+	// A conditional write returns the new ETag, ready for the next one
+	request := httptest.NewRequest("POST", "/set", strings.NewReader(`{"key": "key", "value": "fourth"}`))
+	request.Header.Set("If-Match", response.Header().Get("ETag"))
+	written := httptest.NewRecorder()
+	handler.SetHandler(written, request)
+	if written.Code != http.StatusOK || written.Header().Get("ETag") != get().Header().Get("ETag") {
+		t.Errorf("Expected the ETag of the new value, got %q (status %d)", written.Header().Get("ETag"), written.Code)
+	}
+	if code := set("fifth", "If-Match", written.Header().Get("ETag")); code != http.StatusOK {
+		t.Errorf("Expected status code %d for the returned ETag, got %d", http.StatusOK, code)
+	}
+
+	del := func(etag string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest("DELETE", "/del?key=key", nil)
+		request.Header.Set("If-Match", etag)
+		response := httptest.NewRecorder()
+		handler.DelHandler(response, request)
+		return response
+	}
+	if response := del(etag); response.Code != http.StatusPreconditionFailed {
+		t.Errorf("Expected status code %d for a delete with a stale ETag, got %d", http.StatusPreconditionFailed, response.Code)
+	}
+	current := get().Header().Get("ETag")
+	response = del(current)
+	if response.Code != http.StatusOK || response.Body.String() != "fifth" {
+		t.Errorf("Expected the delete to return fifth, got %q (status %d)", response.Body.String(), response.Code)
+	}
+	if etag := response.Header().Get("ETag"); etag == "" || etag == current {
+		t.Errorf("Expected the delete to return a new ETag, got %q", etag)
+	}
+
+	if code := set("value", "If-Match", "12"); code != http.StatusBadRequest {
+		t.Errorf("Expected status code %d for an unquoted ETag, got %d", http.StatusBadRequest, code)
+	}
+}
+
+func TestAPISetWithTTL(t *testing.T) {
+	memDB := openTestDB(t, t.TempDir())
+	defer memDB.Close()
+	handler := &Handler{db: &LSTM{MemDB: memDB}}
+
+	set := func(body string) int {
+		response := httptest.NewRecorder()
+		handler.SetHandler(response, httptest.NewRequest("POST", "/set", strings.NewReader(body)))
+		return response.Code
+	}
+	get := func(key string) *httptest.ResponseRecorder {
+		response := httptest.NewRecorder()
+		handler.GetHandler(response, httptest.NewRequest("GET", "/get?key="+key, nil))
+		return response
+	}
+
+	if code := set(`{"key": "session", "value": "data", "ttl_seconds": 60}`); code != http.StatusOK {
+		t.Fatalf("Expected status code %d for a set with TTL, got %d", http.StatusOK, code)
+	}
+	if code := set(`{"key": "plain", "value": "data"}`); code != http.StatusOK {
+		t.Fatalf("Expected status code %d for a set, got %d", http.StatusOK, code)
+	}
+
+	response := get("session")
+	if response.Body.String() != "data" || response.Header().Get("X-Remaining-TTL") != "60" {
+		t.Errorf("Expected data with 60 seconds left, got %q with %q", response.Body.String(), response.Header().Get("X-Remaining-TTL"))
+	}
+	if header := get("plain").Header().Get("X-Remaining-TTL"); header != "" {
+		t.Errorf("Expected no TTL header for a key that does not expire, got %q", header)
+	}
+
+	// A conditional write keeps its TTL
+	request := httptest.NewRequest("POST", "/set", strings.NewReader(`{"key": "session", "value": "renewed", "ttl_seconds": 120}`))
+	request.Header.Set("If-Match", response.Header().Get("ETag"))
+	renewed := httptest.NewRecorder()
+	handler.SetHandler(renewed, request)
+	if renewed.Code != http.StatusOK {
+		t.Errorf("Expected status code %d for a conditional set with TTL, got %d", http.StatusOK, renewed.Code)
+	}
+	if header := get("session").Header().Get("X-Remaining-TTL"); header != "120" {
+		t.Errorf("Expected 120 seconds left after renewal, got %q", header)
+	}
+
+	for _, body := range []string{
+		`{"key": "session", "value": "data", "ttl_seconds": 0}`,
+		`{"key": "session", "value": "data", "ttl_seconds": -5}`,
+		`{"key": "session", "value": "data", "ttl_seconds": "soon"}`,
+		`{"key": "session", "value": "data", "ttl_seconds": 9000000000}`,
+	} {
+		if code := set(body); code != http.StatusBadRequest {
+			t.Errorf("Expected status code %d for %s, got %d", http.StatusBadRequest, body, code)
+		}
+	}
+}
@@ -1,19 +1,53 @@
 package main
 
 import (
-	"bufio"
-	"encoding/json"
 	"errors"
 	"fmt"
+	"math"
 	"os"
+	"path/filepath"
 	"sort"
-	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // KeyValue represents a key-value pair.
+// Deleted marks a tombstone that hides older values of Key, and Seq is the
+// sequence number of the write that stored this version of Key. ExpiresAt is
+// the Unix time in nanoseconds at which a value expires, or 0 if it never
+// does. An expired value hides older values like a tombstone.
 type KeyValue struct {
-	Key   string
-	Value string
+	Key       string
+	Value     string
+	Deleted   bool
+	Seq       uint64
+	ExpiresAt int64
+}
+
+// expired reports whether kv is a value that has expired by now, a Unix
+// time in nanoseconds.
+func (kv KeyValue) expired(now int64) bool {
+	return !kv.Deleted && kv.ExpiresAt != 0 && kv.ExpiresAt <= now
+}
+
+// tombstoneIfExpired turns kv into a tombstone if it has expired by now.
+// Both hide the older values of the key, but a tombstone holds no value and
+// is dropped once no older file holds the key.
+func (kv KeyValue) tombstoneIfExpired(now int64) KeyValue {
+	if kv.expired(now) {
+		return KeyValue{Key: kv.Key, Deleted: true, Seq: kv.Seq}
+	}
+	return kv
+}
+
+// lessKeyValue orders entries by key, then newest version first. Memtables,
+// SST files and merges all keep entries in this order.
+func lessKeyValue(a, b KeyValue) bool {
+	if a.Key != b.Key {
+		return a.Key < b.Key
+	}
+	return a.Seq > b.Seq
 }
 
 type Cmd int
@@ -33,56 +67,139 @@ func (e Error) Error() string {
 }
 
 const (
-	Empty     Error = iota
-	threshold int   = 3
+	Empty Error = iota
 )
 
 type DB interface {
 	Set(key string, value string) error
 	Get(key string) (string, error)
 	Del(key string) (string, error)
+	Write(batch *WriteBatch) error
+	NewIterator(opts IteratorOptions) *Iterator
+	Snapshot() *Snapshot
+	Begin() *Txn
+	GetEntry(key string) (ValueMarkerPair, error)
+	SetWithTTL(key, value string, ttl time.Duration) error
+	WriteIf(key string, batch *WriteBatch, cond Condition) (uint64, bool, error)
+	DelIf(key string, cond Condition) (bool, error)
 }
 
 type ValueMarkerPair struct {
-	Value  string
-	Marker bool
+	Value     string
+	Marker    bool
+	Seq       uint64
+	ExpiresAt int64
+}
+
+// expired reports whether the pair is a value that has expired by now, a
+// Unix time in nanoseconds.
+func (pair ValueMarkerPair) expired(now int64) bool {
+	return pair.Marker && pair.ExpiresAt != 0 && pair.ExpiresAt <= now
+}
+
+// Memtable holds the writes that are not flushed to an SST file yet. Every
+// write adds a version of its key under its sequence number, a false marker
+// is a tombstone, and expiresAt is the expiry time of a value, see KeyValue.
+// Implementations must allow Lookup, Len, ApproximateSize, GetKeyValues and
+// the iterators of NewIterator to run concurrently with a single goroutine
+// calling Set.
+type Memtable interface {
+	Set(key string, value string, marker bool, seq uint64, expiresAt int64)
+	// Lookup returns the newest version of key numbered at most seq.
+	Lookup(key string, seq uint64) (ValueMarkerPair, bool)
+	// Len returns the number of versions held.
+	Len() int
+	ApproximateSize() int64
+	// GetKeyValues returns every version, ordered by lessKeyValue.
+	GetKeyValues() []KeyValue
+	// NewIterator returns an iterator over every version, ordered by
+	// lessKeyValue. Versions set after it is created may be seen too.
+	NewIterator() internalIterator
+}
+
+// memtableEntryOverhead approximates the memory used by a memtable entry on
+// top of its key and value: string headers, pointers and skiplist links.
+const memtableEntryOverhead = 64
+
+// entrySize returns the approximate memory used by a memtable entry.
+func entrySize(key, value string) int64 {
+	return int64(memtableEntryOverhead + len(key) + len(value))
 }
 
+// MemtableType selects the Memtable implementation of a store.
+type MemtableType int
+
+const (
+	// SkiplistMemtable uses a Skiplist.
+	SkiplistMemtable MemtableType = iota
+	// SortedSliceMemtable uses a SortedKeyValueStore.
+	SortedSliceMemtable
+)
+
+func newMemtable(memtableType MemtableType) Memtable {
+	if memtableType == SortedSliceMemtable {
+		return NewSortedKeyValueStore()
+	}
+	return NewSkiplist()
+}
+
+// SortedKeyValueStore is a memtable kept as a map of the versions of every
+// key plus a sorted slice of its keys. Inserting a new key takes O(n). It is
+// guarded by a read-write lock.
 type SortedKeyValueStore struct {
-	values  map[string]ValueMarkerPair
-	keys    []string
-	markers map[string]bool
+	mu       sync.RWMutex
+	values   map[string][]ValueMarkerPair // Versions of every key, newest first
+	keys     []string
+	versions int
+	size     int64
 }
 
 func NewSortedKeyValueStore() *SortedKeyValueStore {
 	return &SortedKeyValueStore{
-		values:  make(map[string]ValueMarkerPair),
-		keys:    make([]string, 0),
-		markers: make(map[string]bool),
+		values: make(map[string][]ValueMarkerPair),
+		keys:   make([]string, 0),
 	}
 }
 
-func (store *SortedKeyValueStore) Set(key string, value string, marker bool) {
-	// If the key already exists, update the value and marker
-	if _, exists := store.values[key]; exists {
-		store.values[key] = ValueMarkerPair{Value: value, Marker: marker}
-	} else {
-		// Otherwise, add the new key
-		store.keys = append(store.keys, key)
-		store.values[key] = ValueMarkerPair{Value: value, Marker: marker}
-		store.markers[key] = marker
-		sort.Strings(store.keys)
+func (store *SortedKeyValueStore) Set(key string, value string, marker bool, seq uint64, expiresAt int64) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	// A new key is inserted in order
+	versions, exists := store.values[key]
+	if !exists {
+		i := sort.SearchStrings(store.keys, key)
+		store.keys = append(store.keys, "")
+		copy(store.keys[i+1:], store.keys[i:])
+		store.keys[i] = key
+	}
+
+	// Versions are usually added newest, in front
+	pair := ValueMarkerPair{Value: value, Marker: marker, Seq: seq, ExpiresAt: expiresAt}
+	i := sort.Search(len(versions), func(i int) bool {
+		return versions[i].Seq <= seq
+	})
+	if i < len(versions) && versions[i].Seq == seq {
+		store.size += int64(len(value) - len(versions[i].Value))
+		versions[i] = pair
+		return
 	}
+	versions = append(versions, ValueMarkerPair{})
+	copy(versions[i+1:], versions[i:])
+	versions[i] = pair
+	store.values[key] = versions
+	store.versions++
+	store.size += entrySize(key, value)
 }
 
 func (store *SortedKeyValueStore) Get(key string) (string, error) {
 	// Check if the key exists
-	if _, exists := store.values[key]; !exists {
+	valueMarkerPair, exists := store.Lookup(key, math.MaxUint64)
+	if !exists {
 		return "", errors.New("Key probably in database")
 	}
 
-	// Retrieve the value and marker for the key
-	valueMarkerPair := store.values[key]
+	// Check the marker for the key
 	if valueMarkerPair.Marker {
 		// If marker is true, return the value
 		return valueMarkerPair.Value, nil
@@ -92,148 +209,480 @@ func (store *SortedKeyValueStore) Get(key string) (string, error) {
 	}
 }
 
+// Lookup returns the value and marker of the newest version of key numbered
+// at most seq, including deleted entries, and whether there is one at all.
+func (store *SortedKeyValueStore) Lookup(key string, seq uint64) (ValueMarkerPair, bool) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	for _, valueMarkerPair := range store.values[key] {
+		if valueMarkerPair.Seq <= seq {
+			return valueMarkerPair, true
+		}
+	}
+	return ValueMarkerPair{}, false
+}
+
+// Len returns the number of versions, deleted ones included.
+func (store *SortedKeyValueStore) Len() int {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	return store.versions
+}
+
+// ApproximateSize returns the bytes used by the entries, see entrySize.
+func (store *SortedKeyValueStore) ApproximateSize() int64 {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	return store.size
+}
+
 // Load loads key-values into the SortedKeyValueStore.
 func (store *SortedKeyValueStore) Load(keyValues []KeyValue) {
 	for _, kv := range keyValues {
-		store.Set(kv.Key, kv.Value, true)
+		store.Set(kv.Key, kv.Value, !kv.Deleted, kv.Seq, kv.ExpiresAt)
 	}
 }
 
+// GetKeyValues returns every version in key order, newest first for each
+// key. Deleted keys are returned as tombstones so they can be persisted.
 func (store *SortedKeyValueStore) GetKeyValues() []KeyValue {
-	keyValues := make([]KeyValue, 0, len(store.keys))
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	keyValues := make([]KeyValue, 0, store.versions)
 
 	for _, key := range store.keys {
-		valueMarkerPair := store.values[key]
-		keyValues = append(keyValues, KeyValue{Key: key, Value: valueMarkerPair.Value})
+		for _, valueMarkerPair := range store.values[key] {
+			keyValues = append(keyValues, KeyValue{Key: key, Value: valueMarkerPair.Value, Deleted: !valueMarkerPair.Marker, Seq: valueMarkerPair.Seq, ExpiresAt: valueMarkerPair.ExpiresAt})
+		}
 	}
 
 	return keyValues
 }
 
+// NewIterator returns an iterator over the versions of the store. It keeps
+// the version it is at rather than a position, so every step looks the
+// version up again under the read lock.
+func (store *SortedKeyValueStore) NewIterator() internalIterator {
+	return &sortedStoreIterator{store: store}
+}
+
+// sortedStoreIterator walks a SortedKeyValueStore. When it is not valid,
+// start tells whether it was moved back past the first version or on past
+// the last, so it can step back in from either side.
+type sortedStoreIterator struct {
+	store   *SortedKeyValueStore
+	current KeyValue
+	ok      bool
+	start   bool
+}
+
+// at positions the iterator at version j of the key at index i, where a
+// negative j counts from the oldest version. store.mu must be held.
+func (it *sortedStoreIterator) at(i, j int) {
+	it.ok = i >= 0 && i < len(it.store.keys)
+	it.start = i < 0
+	if !it.ok {
+		return
+	}
+	key := it.store.keys[i]
+	versions := it.store.values[key]
+	if j < 0 {
+		j += len(versions)
+	}
+	pair := versions[j]
+	it.current = KeyValue{Key: key, Value: pair.Value, Deleted: !pair.Marker, Seq: pair.Seq, ExpiresAt: pair.ExpiresAt}
+}
+
+func (it *sortedStoreIterator) seek(key string) {
+	it.store.mu.RLock()
+	defer it.store.mu.RUnlock()
+	it.at(sort.SearchStrings(it.store.keys, key), 0)
+}
+
+func (it *sortedStoreIterator) seekBefore(key string) {
+	it.store.mu.RLock()
+	defer it.store.mu.RUnlock()
+	it.at(sort.SearchStrings(it.store.keys, key)-1, -1)
+}
+
+func (it *sortedStoreIterator) seekToFirst() {
+	it.store.mu.RLock()
+	defer it.store.mu.RUnlock()
+	it.at(0, 0)
+}
+
+func (it *sortedStoreIterator) seekToLast() {
+	it.store.mu.RLock()
+	defer it.store.mu.RUnlock()
+	it.at(len(it.store.keys)-1, -1)
+}
+
+// next moves to the next older version of the key, or to the newest version
+// of the next key. Keys are never removed, so the current one is still there.
+func (it *sortedStoreIterator) next() {
+	it.store.mu.RLock()
+	defer it.store.mu.RUnlock()
+	if !it.ok {
+		if it.start {
+			it.at(0, 0)
+		}
+		return
+	}
+	i := sort.SearchStrings(it.store.keys, it.current.Key)
+	versions := it.store.values[it.current.Key]
+	j := sort.Search(len(versions), func(j int) bool {
+		return versions[j].Seq < it.current.Seq
+	})
+	if j < len(versions) {
+		it.at(i, j)
+	} else {
+		it.at(i+1, 0)
+	}
+}
+
+// prev moves to the next newer version of the key, or to the oldest version
+// of the previous key.
+func (it *sortedStoreIterator) prev() {
+	it.store.mu.RLock()
+	defer it.store.mu.RUnlock()
+	if !it.ok {
+		if !it.start {
+			it.at(len(it.store.keys)-1, -1)
+		}
+		return
+	}
+	i := sort.SearchStrings(it.store.keys, it.current.Key)
+	versions := it.store.values[it.current.Key]
+	j := sort.Search(len(versions), func(j int) bool {
+		return versions[j].Seq <= it.current.Seq
+	})
+	if j > 0 {
+		it.at(i, j-1)
+	} else {
+		it.at(i-1, -1)
+	}
+}
+
+func (it *sortedStoreIterator) valid() bool     { return it.ok }
+func (it *sortedStoreIterator) entry() KeyValue { return it.current }
+func (it *sortedStoreIterator) error() error    { return nil }
+
+// MemDB is the store. It is safe for use by many goroutines at once:
+//
+//   - Reads run concurrently with each other and with writes. Get holds mu
+//     for reading, which keeps the memtables and the SST files it looks at
+//     in place, and the memtable allows lookups during an insert.
+//   - Writes are serialized by writeMu, which covers the WAL append, the
+//     memtable insert and the memtable rotation, so records reach the WAL
+//     and the memtable in the same order. Del holds it from its lookup to
+//     its tombstone. The wait for the WAL fsync happens after writeMu is
+//     released, so concurrent writers share one fsync.
+//   - mu is only held exclusively for short swaps: rotating the memtable,
+//     changing options and deleting compacted SST files.
+//
+// A write is visible to readers as soon as it is in the memtable, which
+// can be shortly before Set returns. Close must not run concurrently with
+// other calls.
 type MemDB struct {
-	sortedKeyValueStore *SortedKeyValueStore
+	memtable            Memtable
+	immutables          []*immutableMemtable // Rotated memtables waiting for a flush, oldest first
 	smallestKey         string
 	largestKey          string
 	wal                 *WAL
+	manifest            *Manifest           // Live set of SST files
+	writeMu             sync.Mutex          // Serializes writes, see above
+	mu                  sync.RWMutex        // Guards the memtables, range keys and options; held while SST files are read, and exclusively to delete them
+	tables              map[string]*SSTFile // Open SST files with their index and bloom filter
+	pinned              map[int]int         // Open iterators per SST file number, guarded by tablesMu
+	obsolete            map[int]bool        // Compacted SST files deleted once unpinned, guarded by tablesMu
+	tablesMu            sync.Mutex
+	opts                Options
+	names               fileNames
+	bloomFalsePositives uint64
+
+	// Versions are numbered by the WAL sequence numbers, see snapshot.go
+	visibleSeq  uint64 // Last sequence number applied to the memtable, read atomically
+	snapshots   map[uint64]int
+	snapshotsMu sync.Mutex
+
+	// Immutable memtables are flushed in a background goroutine, see flush.go
+	flushed    *sync.Cond // Signaled on mu when a flush ends
+	flushErr   error      // Error of the last flush, guarded by mu
+	rotatedSeq uint64     // Last sequence number of the newest immutable memtable
+	flushCh    chan struct{}
+	stopFlush  chan struct{}
+	flushDone  chan struct{}
+
+	// Compaction runs in a background goroutine, see compaction.go
+	compactionMu   sync.Mutex // Serializes compactions
+	strategy       compactionStrategy
+	compactions    uint64
+	bytesFlushed   uint64
+	bytesCompacted uint64
+	compactCh      chan struct{}
+	stopCompaction chan struct{}
+	compactionDone chan struct{}
+
+	// Expired values are swept from the memtable in a background
+	// goroutine, see ttl.go. sweepDone is nil while it is not running.
+	expiredSwept uint64
+	stopSweep    chan struct{}
+	sweepDone    chan struct{}
+}
+
+// Stats reports counters about the store.
+type Stats struct {
+	// BloomBitsPerKey is the bloom filter size used for new SST files.
+	BloomBitsPerKey int
+	// BloomFalsePositives counts SST lookups that passed the bloom filter
+	// but did not find the key.
+	BloomFalsePositives uint64
+	// MemtableSize is the approximate number of bytes used by the memtable,
+	// and MemtableKeys the number of versions it holds.
+	MemtableSize int64
+	MemtableKeys int
+	// ImmutableMemtables is the number of memtables waiting for a flush.
+	ImmutableMemtables int
+	// LevelFiles is the number of live SST files per level.
+	LevelFiles []int
+	// CompactionStyle is the compaction strategy in use.
+	CompactionStyle CompactionStyle
+	// Compactions counts the compactions run since the store was opened.
+	Compactions uint64
+	// BytesFlushed and BytesCompacted count the bytes of SST files written
+	// by flushes and by compactions since the store was opened.
+	BytesFlushed   uint64
+	BytesCompacted uint64
+	// WriteAmplification is the number of bytes written to SST files per
+	// byte flushed, or 0 before the first flush.
+	WriteAmplification float64
+	// ExpiredSwept counts the expired values the memtable sweeper has turned
+	// into tombstones since the store was opened.
+	ExpiredSwept uint64
 }
 
+// NewMemDB opens the store in the working directory with the default
+// options. It returns nil if the store cannot be opened.
 func NewMemDB() *MemDB {
-	wal, err := NewWAL("wal")
+	mem, err := Open(".", DefaultOptions())
 	if err != nil {
 		return nil
 	}
+	return mem
+}
 
-	mem := &MemDB{
-		sortedKeyValueStore: NewSortedKeyValueStore(),
-		wal:                 wal,
+// Open opens the store kept in dir, creating it if needed, and recovers the
+// writes that were not flushed yet. Stores in different directories are
+// independent, so several can be open in one process.
+func Open(dir string, opts Options) (*MemDB, error) {
+	if dir != "" {
+		opts.Dir = dir
+	}
+	opts = opts.withDefaults()
+	names := opts.fileNames()
+	if err := os.MkdirAll(opts.Dir, 0755); err != nil {
+		return nil, err
 	}
 
-	// Recover from WAL
-	mem.recoverFromWAL()
+	manifest, err := OpenManifest(names)
+	if err != nil {
+		return nil, err
+	}
 
-	return mem
-}
+	// Files deeper than the last level could never be compacted or reported
+	if files := manifest.Files(); len(files) > 0 && files[len(files)-1].Level >= opts.NumLevels {
+		manifest.Close()
+		return nil, fmt.Errorf("Store has files in level %d, but NumLevels is %d", files[len(files)-1].Level, opts.NumLevels)
+	}
 
-// recoverFromWAL replays WAL operations to reconstruct the MemDB state.
-func (mem *MemDB) recoverFromWAL() {
-	// Iterate through the WAL starting from the last successfully flushed index (watermark)
-	for i := mem.wal.watermark; i < mem.wal.currentIndex; i++ {
-		walRecord, err := readWALRecord(i)
-		if err != nil {
-			// Handle the error, possibly log it
-			continue
-		}
+	mem := &MemDB{
+		memtable:       newMemtable(opts.MemtableType),
+		manifest:       manifest,
+		tables:         make(map[string]*SSTFile),
+		pinned:         make(map[int]int),
+		snapshots:      make(map[uint64]int),
+		obsolete:       make(map[int]bool),
+		opts:           opts,
+		names:          names,
+		rotatedSeq:     manifest.LastSeq(),
+		flushCh:        make(chan struct{}, 1),
+		stopFlush:      make(chan struct{}),
+		flushDone:      make(chan struct{}),
+		strategy:       newCompactionStrategy(opts),
+		compactCh:      make(chan struct{}, 1),
+		stopCompaction: make(chan struct{}),
+		compactionDone: make(chan struct{}),
+		stopSweep:      make(chan struct{}),
+	}
 
-		// Replay the WAL operation
-		switch walRecord.Operation {
-		case SetOperation:
-			mem.sortedKeyValueStore.Set(walRecord.Key, walRecord.Value, true)
-		case DelOperation:
-			val, _ := mem.sortedKeyValueStore.Get(walRecord.Key)
-			mem.sortedKeyValueStore.Set(walRecord.Key, val, false)
+	// Recover from WAL while it is opened. Segments the MANIFEST has
+	// already flushed may be left by a crash before they were deleted.
+	wal, err := NewWAL(names.wal(), func(walRecord *WALRecord) {
+		if walRecord.lastSeq() > manifest.LastSeq() {
+			mem.apply(walRecord)
 		}
+	})
+	if err != nil {
+		manifest.Close()
+		return nil, err
 	}
+	wal.SetSyncPolicy(opts.SyncPolicy, opts.SyncInterval)
+	mem.wal = wal
+
+	// Sequence numbers continue after the flushed records, whose WAL
+	// segments may be gone
+	wal.advanceSeq(manifest.LastSeq())
+	if err := wal.Release(manifest.LogNumber()); err != nil {
+		wal.Close()
+		manifest.Close()
+		return nil, err
+	}
+	atomic.StoreUint64(&mem.visibleSeq, wal.LastSeq())
 
-	// Set the smallest and largest keys based on the recovered state
-	mem.setRangeKeys("", "")
-}
+	mem.flushed = sync.NewCond(&mem.mu)
+	go mem.backgroundFlush()
+	go mem.backgroundCompaction()
 
-// readWALRecord reads a WALRecord at the specified index.
-func readWALRecord(index int) (*WALRecord, error) {
-	// Open the WAL file
-	file, err := os.Open("wal")
-	if err != nil {
+	// SST files left out of the MANIFEST were never made live
+	if err := mem.removeObsoleteFiles(); err != nil {
+		mem.Close()
 		return nil, err
 	}
-	defer file.Close()
 
-	// Read and discard records until reaching the desired index
-	scanner := bufio.NewScanner(file)
-	for i := 0; i < index; i++ {
-		if !scanner.Scan() {
-			return nil, errors.New("index out of bounds")
-		}
+	mem.scheduleCompaction()
+	if opts.TTLSweepInterval > 0 {
+		mem.sweepDone = make(chan struct{})
+		go mem.backgroundSweep()
 	}
+	return mem, nil
+}
 
-	// Read the record at the desired index
-	if !scanner.Scan() {
-		return nil, errors.New("index out of bounds")
+// removeObsoleteFiles deletes the SST files that are not in the live set,
+// and the temporary files of SST files that were never completed.
+func (mem *MemDB) removeObsoleteFiles() error {
+	temps, err := filepath.Glob(mem.names.sstGlob() + sstTempSuffix)
+	if err != nil {
+		return err
+	}
+	for _, temp := range temps {
+		if err := os.Remove(temp); err != nil {
+			return err
+		}
 	}
-	recordStr := scanner.Text()
 
-	// Deserialize the record
-	var record WALRecord
-	err = json.Unmarshal([]byte(recordStr), &record)
+	matches, err := filepath.Glob(mem.names.sstGlob())
 	if err != nil {
-		return nil, err
+		return err
+	}
+
+	live := make(map[int]bool)
+	for _, meta := range mem.manifest.Files() {
+		live[meta.Number] = true
+	}
+	for _, match := range matches {
+		if number, ok := mem.names.parseSST(match); ok && !live[number] {
+			if err := os.Remove(match); err != nil {
+				return err
+			}
+		}
 	}
+	return nil
+}
 
-	return &record, nil
+// apply adds the writes of record to the memtable, under their sequence
+// numbers.
+func (mem *MemDB) apply(record *WALRecord) {
+	switch record.Operation {
+	case SetOperation:
+		mem.memtable.Set(record.Key, record.Value, true, record.Seq, record.ExpiresAt)
+	case DelOperation:
+		mem.memtable.Set(record.Key, "", false, record.Seq, 0)
+	case BatchOperation:
+		for i, op := range record.Batch {
+			mem.memtable.Set(op.Key, op.Value, op.Operation != DelOperation, record.Seq+uint64(i), op.ExpiresAt)
+		}
+	}
 }
 
 // Add a method to set the smallest and largest keys
 func (mem *MemDB) setRangeKeys(smallestKey, largestKey string) {
+	mem.mu.Lock()
+	defer mem.mu.Unlock()
+
 	mem.smallestKey = smallestKey
 	mem.largestKey = largestKey
 }
 
-// New function to check the threshold and flush data into SST files
+// New function to check the threshold and hand the memtable over to the
+// background flush. writeMu must be held.
 func (mem *MemDB) checkAndFlush() error {
-	fmt.Println("Checking threshold...")
-	fmt.Println("Current key count:", len(mem.sortedKeyValueStore.keys))
-	if len(mem.sortedKeyValueStore.keys) > threshold {
-		// Increment the file index for naming
-		mem.wal.Flush()
-
-		// Flush the SortedKeyValueStore to an SST file
-		keyValues := mem.sortedKeyValueStore.GetKeyValues()
-		filename := "mohieddine_" + strconv.Itoa(mem.wal.currentIndex) + ".sst" // Adjust the naming convention as needed
-		fmt.Println("Flushing to SST file:", filename)
-		err := flushSSTFile(filename, keyValues)
-		if err != nil {
+	if mem.memtable.ApproximateSize() > mem.opts.MemtableSize {
+		if err := mem.rotateMemtable(); err != nil {
 			return err
 		}
-
-		// Clear the SortedKeyValueStore after flushing
-		mem.sortedKeyValueStore = NewSortedKeyValueStore()
 		mem.setRangeKeys("", "") // Reset range keys for the new SST file
 	}
 	return nil
 }
 
 func (mem *MemDB) Set(key, value string) error {
-	mem.wal.WriteRecord(WALRecord{Operation: "Set", Key: key, Value: value})
+	return mem.set(NewSetWALRecord(key, value))
+}
 
-	// Check if the key is within the range of keys in the SST file
-	mem.sortedKeyValueStore.Set(key, value, true)
+// SetWithTTL sets the value of key for ttl, counted from the call. Once it
+// has expired, the key reads as deleted and its value is dropped by the
+// memtable sweeper, flushes and compactions.
+func (mem *MemDB) SetWithTTL(key, value string, ttl time.Duration) error {
+	if ttl <= 0 {
+		return errors.New("TTL must be positive")
+	}
+	record := NewSetWALRecord(key, value)
+	expiresAt, ok := expiryAfter(record.Timestamp, ttl)
+	if !ok {
+		return errors.New("TTL too long")
+	}
+	record.ExpiresAt = expiresAt
+	return mem.set(record)
+}
 
-	// Check and flush if threshold is reached
-	err := mem.checkAndFlush()
+func (mem *MemDB) set(record WALRecord) error {
+	mem.writeMu.Lock()
+	seq, err := mem.write(record)
+	mem.writeMu.Unlock()
 	if err != nil {
 		return err
 	}
 
-	return nil
+	// The write is durable as configured by the sync policy once this returns
+	return mem.wal.waitDurable(seq)
+}
+
+// write appends record to the WAL and applies it to the memtable, then
+// rotates the memtable if it is full. It returns the sequence number of
+// the last write in the record. writeMu must be held.
+func (mem *MemDB) write(record WALRecord) (uint64, error) {
+	// A memtable left full by a failed rotation is rotated before the record
+	// is logged, so a write either fails here or not at all
+	if err := mem.checkAndFlush(); err != nil {
+		return 0, err
+	}
+	if err := mem.wal.appendRecord(&record); err != nil {
+		return 0, err
+	}
+
+	// Only writers swap the memtable, so it can be used without mu here.
+	// Readers only see the record once all of it is in.
+	mem.apply(&record)
+	seq := record.lastSeq()
+	atomic.StoreUint64(&mem.visibleSeq, seq)
+
+	// The record is in, so a failed rotation is left to the next write
+	mem.checkAndFlush()
+	return seq, nil
 }
 
 func (mem *MemDB) LoadSSTFile(filename string) error {
@@ -242,54 +691,328 @@ func (mem *MemDB) LoadSSTFile(filename string) error {
 		return err
 	}
 
-	mem.sortedKeyValueStore.Load(keyValues)
+	mem.writeMu.Lock()
+	defer mem.writeMu.Unlock()
+	for _, kv := range keyValues {
+		mem.memtable.Set(kv.Key, kv.Value, !kv.Deleted, kv.Seq, kv.ExpiresAt)
+	}
 	mem.setRangeKeys(smallestKey, largestKey)
 	return nil
 }
 
+// Get returns the value of key as of the last write applied, so a batch
+// being applied is seen all at once.
 func (mem *MemDB) Get(key string) (string, error) {
+	return mem.get(key, atomic.LoadUint64(&mem.visibleSeq))
+}
+
+// get returns the newest value of key numbered at most seq.
+func (mem *MemDB) get(key string, seq uint64) (string, error) {
+	entry, err := mem.getEntry(key, seq)
+	return entry.Value, err
+}
+
+// getEntry returns the newest value of key numbered at most seq, with its
+// sequence number and expiry time.
+func (mem *MemDB) getEntry(key string, seq uint64) (ValueMarkerPair, error) {
+	mem.mu.RLock()
+	defer mem.mu.RUnlock()
+
 	// Check if the key is within the range of keys in the SST files
 	if (key < mem.smallestKey || key > mem.largestKey) && mem.smallestKey != "" && mem.largestKey != "" {
-		return "", errors.New("Key probably in database")
+		return ValueMarkerPair{}, errors.New("Key probably in database")
 	}
 
-	// Retrieve the value and marker for the key from the SortedKeyValueStore
-	valueMarkerPair, exists := mem.sortedKeyValueStore.Get(key)
-	if exists == nil && valueMarkerPair != "" {
-		// If the key is found in the SortedKeyValueStore and marked as present
-		return valueMarkerPair, nil
+	valueMarkerPair, found, err := mem.lookup(key, seq)
+	if err != nil {
+		return ValueMarkerPair{}, err
+	}
+	if !found || !valueMarkerPair.Marker || valueMarkerPair.expired(time.Now().UnixNano()) {
+		// A deleted or expired key hides every older value
+		return ValueMarkerPair{}, errors.New("Key not found")
+	}
+	return valueMarkerPair, nil
+}
+
+// lookup returns the newest version of key numbered at most seq, which is a
+// tombstone if its Marker is false. found is false if there is no such
+// version. Callers hold mu for reading.
+func (mem *MemDB) lookup(key string, seq uint64) (ValueMarkerPair, bool, error) {
+	// Retrieve the value and marker for the key from the memtable, then from
+	// the immutable memtables waiting for a flush, newest first
+	memtables := []Memtable{mem.memtable}
+	for i := len(mem.immutables) - 1; i >= 0; i-- {
+		memtables = append(memtables, mem.immutables[i].memtable)
+	}
+	for _, memtable := range memtables {
+		if valueMarkerPair, exists := memtable.Lookup(key, seq); exists {
+			return valueMarkerPair, true, nil
+		}
 	}
 
 	// Check SST files from the most recent to the least recent
-	for i := mem.wal.currentIndex; i >= 0; i-- {
-		sstFile := "mohieddine_" + strconv.Itoa(i) + ".sst" // Adjust the naming convention as needed
-		keyValues, _, _, err := parseSSTFile(sstFile)
-		if err != nil {
-			// Handle the error, possibly log it
+	for _, meta := range mem.manifest.Files() {
+		if key < meta.Smallest || key > meta.Largest {
 			continue
 		}
+		table, err := mem.table(mem.names.sst(meta.Number))
+		if err != nil {
+			// Skipping a missing or corrupt file could return an older value
+			return ValueMarkerPair{}, false, err
+		}
 
-		// Iterate through key-values in the SST file
-		for _, kv := range keyValues {
-			if kv.Key == key {
-				// If the key is found in the SST file, return the associated value
-				return kv.Value, nil
+		// Skip files whose bloom filter rules the key out
+		if !table.mayContain(key) {
+			continue
+		}
+		kv, found, err := table.Get(key, seq)
+		if err != nil {
+			return ValueMarkerPair{}, false, err
+		}
+		if !found {
+			// Files without a filter were read because they could not be ruled out
+			if table.filter != nil {
+				atomic.AddUint64(&mem.bloomFalsePositives, 1)
 			}
+			continue
 		}
+
+		// The newest entry for the key wins, tombstones included
+		return ValueMarkerPair{Value: kv.Value, Marker: !kv.Deleted, Seq: kv.Seq, ExpiresAt: kv.ExpiresAt}, true, nil
 	}
 
 	// Key not found in MemDB or SST files
-	return "", errors.New("Key not found")
+	return ValueMarkerPair{}, false, nil
 }
 
 func (mem *MemDB) Del(key string) (string, error) {
-	mem.wal.WriteRecord(WALRecord{Operation: "Del", Key: key})
-
-	// Check if the key is within the range of keys in the SST file
+	// Hold writeMu from the lookup on, so the value returned is the one deleted
+	mem.writeMu.Lock()
 	val, err := mem.Get(key)
 	if err != nil {
+		mem.writeMu.Unlock()
+		return "", err
+	}
+
+	// Keep a tombstone so the delete also hides values in older SST files
+	seq, err := mem.write(NewDelWALRecord(key))
+	mem.writeMu.Unlock()
+	if err != nil {
+		return "", err
+	}
+
+	if err := mem.wal.waitDurable(seq); err != nil {
 		return "", err
 	}
-	mem.sortedKeyValueStore.Set(key, val, false)
 	return val, nil
 }
+
+// dropObsoleteVersions removes the versions that no reader can see, see
+// versionFilter, and the tombstones for keys that no SST file holds. Such a
+// tombstone has nothing left to hide, so writing it out is wasted space.
+// Expired values are treated as tombstones.
+func (mem *MemDB) dropObsoleteVersions(keyValues []KeyValue) []KeyValue {
+	filter := newVersionFilter(mem.liveSnapshots())
+
+	mem.mu.RLock()
+	defer mem.mu.RUnlock()
+
+	now := time.Now().UnixNano()
+	kept := keyValues[:0]
+	for _, kv := range keyValues {
+		kv = kv.tombstoneIfExpired(now)
+		if !filter.keep(kv) {
+			continue
+		}
+		if kv.Deleted && filter.visibleToAll(kv) && !mem.olderFilesContain(kv.Key, mem.manifest.Files()) {
+			continue
+		}
+		kept = append(kept, kv)
+	}
+	return kept
+}
+
+// olderFilesContain reports whether any of files holds an entry for key,
+// live or deleted.
+func (mem *MemDB) olderFilesContain(key string, files []FileMeta) bool {
+	for _, meta := range files {
+		if key < meta.Smallest || key > meta.Largest {
+			continue
+		}
+		table, err := mem.table(mem.names.sst(meta.Number))
+		if err != nil {
+			// Keep the tombstone if a file could not be checked
+			return true
+		}
+		if !table.mayContain(key) {
+			continue
+		}
+		if _, found, err := table.Get(key, math.MaxUint64); found || err != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// table returns the open SST file for filename, opening it on first use.
+func (mem *MemDB) table(filename string) (*SSTFile, error) {
+	mem.tablesMu.Lock()
+	defer mem.tablesMu.Unlock()
+
+	if table, ok := mem.tables[filename]; ok {
+		return table, nil
+	}
+	table, err := openSSTFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	mem.tables[filename] = table
+	return table, nil
+}
+
+// evictTable closes the cached SST file for filename, if any.
+func (mem *MemDB) evictTable(filename string) {
+	mem.tablesMu.Lock()
+	defer mem.tablesMu.Unlock()
+
+	mem.evictTableLocked(filename)
+}
+
+func (mem *MemDB) evictTableLocked(filename string) {
+	if table, ok := mem.tables[filename]; ok {
+		table.close()
+		delete(mem.tables, filename)
+	}
+}
+
+// deleteTable closes and removes an SST file that is no longer live. A file
+// still used by an iterator is removed when the last one is closed.
+func (mem *MemDB) deleteTable(number int) error {
+	mem.tablesMu.Lock()
+	defer mem.tablesMu.Unlock()
+
+	if mem.pinned[number] > 0 {
+		mem.obsolete[number] = true
+		return nil
+	}
+	return mem.removeTableLocked(number)
+}
+
+func (mem *MemDB) removeTableLocked(number int) error {
+	filename := mem.names.sst(number)
+	mem.evictTableLocked(filename)
+	if err := os.Remove(filename); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// pinTables keeps files on disk until they are unpinned.
+func (mem *MemDB) pinTables(files []FileMeta) {
+	mem.tablesMu.Lock()
+	defer mem.tablesMu.Unlock()
+
+	for _, meta := range files {
+		mem.pinned[meta.Number]++
+	}
+}
+
+// unpinTables releases files pinned by pinTables, and removes the ones that
+// were compacted away in the meantime.
+func (mem *MemDB) unpinTables(numbers []int) error {
+	mem.tablesMu.Lock()
+	defer mem.tablesMu.Unlock()
+
+	var firstErr error
+	for _, number := range numbers {
+		if mem.pinned[number]--; mem.pinned[number] > 0 {
+			continue
+		}
+		delete(mem.pinned, number)
+		if mem.obsolete[number] {
+			delete(mem.obsolete, number)
+			if err := mem.removeTableLocked(number); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
+
+// SetSyncPolicy sets when the WAL is fsynced, see SyncPolicy. Writes return
+// once they reach the configured durability.
+func (mem *MemDB) SetSyncPolicy(policy SyncPolicy, interval time.Duration) {
+	mem.mu.Lock()
+	mem.opts.SyncPolicy, mem.opts.SyncInterval = policy, interval
+	mem.mu.Unlock()
+	mem.wal.SetSyncPolicy(policy, interval)
+}
+
+// SetBloomBitsPerKey sets the bloom filter size for SST files written from
+// now on. Zero or less disables the filters.
+func (mem *MemDB) SetBloomBitsPerKey(bitsPerKey int) {
+	mem.mu.Lock()
+	defer mem.mu.Unlock()
+
+	mem.opts.BloomBitsPerKey = bitsPerKey
+}
+
+// bloomBitsPerKey returns the bloom filter size for new SST files.
+func (mem *MemDB) bloomBitsPerKey() int {
+	mem.mu.RLock()
+	defer mem.mu.RUnlock()
+
+	return mem.opts.BloomBitsPerKey
+}
+
+// Stats returns the current counters of the store.
+func (mem *MemDB) Stats() Stats {
+	mem.mu.RLock()
+	memtableSize, memtableKeys, immutables := mem.memtable.ApproximateSize(), mem.memtable.Len(), len(mem.immutables)
+	bloomBitsPerKey := mem.opts.BloomBitsPerKey
+	mem.mu.RUnlock()
+
+	levelFiles := make([]int, mem.opts.NumLevels)
+	for _, meta := range mem.manifest.Files() {
+		levelFiles[meta.Level]++
+	}
+	stats := Stats{
+		BloomBitsPerKey:     bloomBitsPerKey,
+		BloomFalsePositives: atomic.LoadUint64(&mem.bloomFalsePositives),
+		MemtableSize:        memtableSize,
+		MemtableKeys:        memtableKeys,
+		ImmutableMemtables:  immutables,
+		LevelFiles:          levelFiles,
+		CompactionStyle:     mem.opts.CompactionStyle,
+		Compactions:         atomic.LoadUint64(&mem.compactions),
+		BytesFlushed:        atomic.LoadUint64(&mem.bytesFlushed),
+		BytesCompacted:      atomic.LoadUint64(&mem.bytesCompacted),
+		ExpiredSwept:        atomic.LoadUint64(&mem.expiredSwept),
+	}
+	if stats.BytesFlushed > 0 {
+		stats.WriteAmplification = float64(stats.BytesFlushed+stats.BytesCompacted) / float64(stats.BytesFlushed)
+	}
+	return stats
+}
+
+// Close stops the memtable sweeper, waits for the pending flushes and stops
+// compaction, then closes the WAL, the MANIFEST and every open SST file.
+// Memtables that could not be flushed are recovered from the WAL on the next
+// open.
+func (mem *MemDB) Close() error {
+	if mem.sweepDone != nil {
+		close(mem.stopSweep)
+		<-mem.sweepDone
+	}
+	mem.waitForFlushes()
+	close(mem.stopFlush)
+	<-mem.flushDone
+	close(mem.stopCompaction)
+	<-mem.compactionDone
+
+	for filename := range mem.tables {
+		mem.evictTable(filename)
+	}
+	mem.manifest.Close()
+	return mem.wal.Close()
+}
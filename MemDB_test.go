@@ -1,12 +1,17 @@
 package main
 
 import (
+	"os"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestMemDBSetGet(t *testing.T) {
-	memDB := NewMemDB()
+	memDB := openTestDB(t, t.TempDir())
 
 	key := "testKey"
 	value := "testValue"
@@ -27,7 +32,7 @@ func TestMemDBSetGet(t *testing.T) {
 }
 
 func TestMemDBDel(t *testing.T) {
-	memDB := NewMemDB()
+	memDB := openTestDB(t, t.TempDir())
 
 	key := "testKey"
 	value := "testValue"
@@ -53,8 +58,8 @@ func TestMemDBDel(t *testing.T) {
 }
 
 func TestMemDBThresholdFlush(t *testing.T) {
-	memDB := NewMemDB()
-	threshold := 3
+	memDB := openTestDB(t, t.TempDir())
+	defer memDB.Close()
 
 	for i := 1; i <= threshold+1; i++ {
 		key := strconv.Itoa(i)
@@ -65,8 +70,501 @@ func TestMemDBThresholdFlush(t *testing.T) {
 		}
 	}
 
-	keyValues := memDB.sortedKeyValueStore.GetKeyValues()
+	keyValues := memDB.memtable.GetKeyValues()
 	if len(keyValues) != 0 {
-		t.Errorf("Expected SortedKeyValueStore to be empty after threshold flush, got %d items", len(keyValues))
+		t.Errorf("Expected the memtable to be empty after threshold flush, got %d items", len(keyValues))
+	}
+}
+
+func TestMemDBDelSurvivesFlush(t *testing.T) {
+	memDB := openTestDB(t, t.TempDir())
+	defer memDB.Close()
+
+	// Flush the key into an SST file
+	for i := 0; i <= threshold; i++ {
+		if err := memDB.Set("key"+strconv.Itoa(i), "value"+strconv.Itoa(i)); err != nil {
+			t.Fatalf("Error setting key-value pair: %v", err)
+		}
+	}
+
+	if _, err := memDB.Del("key0"); err != nil {
+		t.Fatalf("Error deleting key-value pair: %v", err)
+	}
+
+	// Flush the tombstone into a newer SST file
+	for i := threshold + 1; i <= 2*threshold; i++ {
+		if err := memDB.Set("key"+strconv.Itoa(i), "value"+strconv.Itoa(i)); err != nil {
+			t.Fatalf("Error setting key-value pair: %v", err)
+		}
+	}
+	if err := memDB.waitForFlushes(); err != nil {
+		t.Fatalf("Error flushing memtable: %v", err)
+	}
+	if len(memDB.memtable.GetKeyValues()) != 0 || len(memDB.manifest.Files()) != 2 {
+		t.Fatal("Expected the tombstone to be flushed")
+	}
+
+	if _, err := memDB.Get("key0"); err == nil {
+		t.Error("Expected error for Get after deletion and flush, but got nil")
+	}
+	if result, err := memDB.Get("key1"); err != nil || result != "value1" {
+		t.Errorf("Expected value1 for key1, got %q (%v)", result, err)
+	}
+}
+
+func TestFlushDropsTombstonesWithoutOlderValues(t *testing.T) {
+	memDB := openTestDB(t, t.TempDir())
+	defer memDB.Close()
+
+	if err := memDB.Set("gone", "value"); err != nil {
+		t.Fatalf("Error setting key-value pair: %v", err)
+	}
+	if _, err := memDB.Del("gone"); err != nil {
+		t.Fatalf("Error deleting key-value pair: %v", err)
+	}
+	for i := 0; i < threshold; i++ {
+		if err := memDB.Set("key"+strconv.Itoa(i), "value"); err != nil {
+			t.Fatalf("Error setting key-value pair: %v", err)
+		}
+	}
+
+	if err := memDB.waitForFlushes(); err != nil {
+		t.Fatalf("Error flushing memtable: %v", err)
+	}
+	keyValues, _, _, err := parseSSTFile(memDB.names.sst(1))
+	if err != nil {
+		t.Fatalf("Error parsing SST file: %v", err)
+	}
+	for _, kv := range keyValues {
+		if kv.Key == "gone" {
+			t.Errorf("Expected tombstone for %q to be dropped, got %+v", kv.Key, kv)
+		}
+	}
+}
+
+// threshold is the number of keys the memtable of testOptions holds before a
+// flush, as long as every key and value take at most 20 bytes together.
+const threshold = 3
+
+// testOptions returns the default options with a memtable budget of
+// threshold small entries.
+func testOptions() Options {
+	opts := DefaultOptions()
+	opts.MemtableSize = threshold * (memtableEntryOverhead + 20)
+	return opts
+}
+
+// openTestDB opens the store kept in dir with testOptions.
+func openTestDB(t *testing.T, dir string) *MemDB {
+	t.Helper()
+	memDB, err := Open(dir, testOptions())
+	if err != nil {
+		t.Fatalf("Error opening MemDB: %v", err)
+	}
+	return memDB
+}
+
+func TestMemDBBloomFilterSkipsFiles(t *testing.T) {
+	memDB := openTestDB(t, t.TempDir())
+	defer memDB.Close()
+
+	for i := 0; i <= 4*threshold; i++ {
+		if err := memDB.Set("key"+strconv.Itoa(i), "value"); err != nil {
+			t.Fatalf("Error setting key-value pair: %v", err)
+		}
+	}
+
+	if err := memDB.waitForFlushes(); err != nil {
+		t.Fatalf("Error flushing memtable: %v", err)
+	}
+	for i := 0; i < 100; i++ {
+		if _, err := memDB.Get("key" + strconv.Itoa(i) + "-missing"); err == nil {
+			t.Fatal("Expected error for missing key, but got nil")
+		}
+	}
+
+	// Every file is checked for each missing key, so almost all of those
+	// checks must have been answered by the filters
+	stats := memDB.Stats()
+	if stats.BloomBitsPerKey != defaultBloomBitsPerKey {
+		t.Errorf("Expected %d bits per key, got %d", defaultBloomBitsPerKey, stats.BloomBitsPerKey)
+	}
+	if stats.BloomFalsePositives > 20 {
+		t.Errorf("Expected few bloom false positives, got %d", stats.BloomFalsePositives)
+	}
+}
+
+func TestMemDBBloomFalsePositivesNeedFilter(t *testing.T) {
+	memDB := openTestDB(t, t.TempDir())
+	defer memDB.Close()
+
+	// Files written without a filter are read for every key in their range
+	memDB.SetBloomBitsPerKey(0)
+	for i := 0; i <= 2*threshold; i++ {
+		if err := memDB.Set("key"+strconv.Itoa(i), "value"); err != nil {
+			t.Fatalf("Error setting key-value pair: %v", err)
+		}
+	}
+
+	if err := memDB.waitForFlushes(); err != nil {
+		t.Fatalf("Error flushing memtable: %v", err)
+	}
+	for i := 0; i < 10; i++ {
+		if _, err := memDB.Get("key" + strconv.Itoa(i) + "-missing"); err == nil {
+			t.Fatal("Expected error for missing key, but got nil")
+		}
+	}
+
+	if stats := memDB.Stats(); stats.BloomFalsePositives != 0 {
+		t.Errorf("Expected no bloom false positives without filters, got %d", stats.BloomFalsePositives)
+	}
+}
+
+func TestMemDBRecoversUnflushedWrites(t *testing.T) {
+	dir := t.TempDir()
+	memDB := openTestDB(t, dir)
+
+	// The first threshold+1 keys are flushed, the rest only live in the WAL
+	for i := 0; i <= threshold+1; i++ {
+		if err := memDB.Set("key"+strconv.Itoa(i), "value"+strconv.Itoa(i)); err != nil {
+			t.Fatalf("Error setting key-value pair: %v", err)
+		}
+	}
+	if _, err := memDB.Del("key1"); err != nil {
+		t.Fatalf("Error deleting key-value pair: %v", err)
+	}
+	if err := memDB.Set("key0", "updated"); err != nil {
+		t.Fatalf("Error setting key-value pair: %v", err)
+	}
+	unflushed := len(memDB.memtable.GetKeyValues())
+	if err := memDB.Close(); err != nil {
+		t.Fatalf("Error closing MemDB: %v", err)
+	}
+
+	memDB = openTestDB(t, dir)
+	defer memDB.Close()
+
+	if got := len(memDB.memtable.GetKeyValues()); got != unflushed {
+		t.Errorf("Expected %d unflushed entries to be replayed, got %d", unflushed, got)
+	}
+	expected := map[string]string{"key0": "updated", "key2": "value2", "key4": "value4"}
+	for key, value := range expected {
+		if result, err := memDB.Get(key); err != nil || result != value {
+			t.Errorf("Expected %s for %s after restart, got %q (%v)", value, key, result, err)
+		}
+	}
+	if _, err := memDB.Get("key1"); err == nil {
+		t.Error("Expected error for Get of a deleted key after restart, but got nil")
+	}
+
+	// New flushes must not overwrite the SST files written before the restart
+	for i := 0; i < threshold; i++ {
+		if err := memDB.Set("new"+strconv.Itoa(i), "value"); err != nil {
+			t.Fatalf("Error setting key-value pair: %v", err)
+		}
+	}
+	if err := memDB.waitForFlushes(); err != nil {
+		t.Fatalf("Error flushing memtable: %v", err)
+	}
+	if _, err := os.Stat(memDB.names.sst(2)); err != nil {
+		t.Errorf("Expected a second SST file after restart: %v", err)
+	}
+	if result, err := memDB.Get("key3"); err != nil || result != "value3" {
+		t.Errorf("Expected value3 for key3, got %q (%v)", result, err)
+	}
+}
+
+func TestMemDBManifestTracksFiles(t *testing.T) {
+	dir := t.TempDir()
+	memDB := openTestDB(t, dir)
+
+	for i := 0; i <= 2*threshold+1; i++ {
+		if err := memDB.Set("key"+strconv.Itoa(i), "value"+strconv.Itoa(i)); err != nil {
+			t.Fatalf("Error setting key-value pair: %v", err)
+		}
+	}
+	if err := memDB.waitForFlushes(); err != nil {
+		t.Fatalf("Error flushing memtable: %v", err)
+	}
+	files := memDB.manifest.Files()
+	if len(files) != 2 {
+		t.Fatalf("Expected 2 live SST files, got %d", len(files))
+	}
+	if files[0].SmallestSeq <= files[1].LargestSeq {
+		t.Errorf("Expected the newer file to hold later sequence numbers, got %+v", files)
+	}
+	memDB.Close()
+
+	// A file that never made it into the MANIFEST is removed on open
+	if err := flushSSTFile(memDB.names.sst(99), []KeyValue{{Key: "key0", Value: "orphan"}}, defaultBloomBitsPerKey); err != nil {
+		t.Fatalf("Error flushing SST file: %v", err)
+	}
+
+	memDB = openTestDB(t, dir)
+	defer memDB.Close()
+	if reopened := memDB.manifest.Files(); len(reopened) != 2 || reopened[0] != files[0] || reopened[1] != files[1] {
+		t.Errorf("Expected the same live files after restart, got %+v", reopened)
+	}
+	if _, err := os.Stat(memDB.names.sst(99)); !os.IsNotExist(err) {
+		t.Errorf("Expected the orphaned SST file to be removed, got %v", err)
+	}
+	if result, err := memDB.Get("key0"); err != nil || result != "value0" {
+		t.Errorf("Expected value0 for key0, got %q (%v)", result, err)
+	}
+	if number := memDB.manifest.NewFileNumber(); number != 3 {
+		t.Errorf("Expected next file number 3, got %d", number)
+	}
+}
+
+func TestOpenIndependentStores(t *testing.T) {
+	first := openTestDB(t, t.TempDir())
+	defer first.Close()
+	opts := testOptions()
+	opts.MemtableSize = 1
+	second, err := Open(t.TempDir(), opts)
+	if err != nil {
+		t.Fatalf("Error opening MemDB: %v", err)
+	}
+	defer second.Close()
+
+	for i := 0; i < 3; i++ {
+		if err := first.Set("key"+strconv.Itoa(i), "first"); err != nil {
+			t.Fatalf("Error setting key-value pair: %v", err)
+		}
+		if err := second.Set("key"+strconv.Itoa(i), "second"); err != nil {
+			t.Fatalf("Error setting key-value pair: %v", err)
+		}
+	}
+
+	if err := second.waitForFlushes(); err != nil {
+		t.Fatalf("Error flushing memtable: %v", err)
+	}
+	if len(first.manifest.Files()) != 0 || len(second.manifest.Files()) == 0 {
+		t.Errorf("Expected only the second store to flush, got %d and %d files", len(first.manifest.Files()), len(second.manifest.Files()))
+	}
+	for _, db := range []struct {
+		memDB *MemDB
+		value string
+	}{{first, "first"}, {second, "second"}} {
+		if result, err := db.memDB.Get("key0"); err != nil || result != db.value {
+			t.Errorf("Expected %s for key0, got %q (%v)", db.value, result, err)
+		}
+	}
+}
+
+func TestMemDBFlushesOnMemtableSize(t *testing.T) {
+	opts := testOptions()
+	opts.MemtableSize = 1024
+	memDB, err := Open(t.TempDir(), opts)
+	if err != nil {
+		t.Fatalf("Error opening MemDB: %v", err)
+	}
+	defer memDB.Close()
+
+	if err := memDB.Set("small", "value"); err != nil {
+		t.Fatalf("Error setting key-value pair: %v", err)
+	}
+	if err := memDB.Set("small", "longer value"); err != nil {
+		t.Fatalf("Error setting key-value pair: %v", err)
+	}
+	// Both versions are kept until the flush
+	stats := memDB.Stats()
+	if expected := entrySize("small", "value") + entrySize("small", "longer value"); stats.MemtableSize != expected || stats.MemtableKeys != 2 {
+		t.Errorf("Expected 2 versions using %d bytes, got %d using %d bytes", expected, stats.MemtableKeys, stats.MemtableSize)
+	}
+
+	// A single value larger than the budget flushes right away
+	large := strings.Repeat("x", 2048)
+	if err := memDB.Set("large", large); err != nil {
+		t.Fatalf("Error setting key-value pair: %v", err)
+	}
+	if err := memDB.waitForFlushes(); err != nil {
+		t.Fatalf("Error flushing memtable: %v", err)
+	}
+	if stats := memDB.Stats(); stats.MemtableSize != 0 || len(memDB.manifest.Files()) != 1 {
+		t.Errorf("Expected the memtable to be flushed, got %d bytes and %d files", stats.MemtableSize, len(memDB.manifest.Files()))
+	}
+	if result, err := memDB.Get("large"); err != nil || result != large {
+		t.Errorf("Expected the large value after the flush, got %d bytes (%v)", len(result), err)
+	}
+}
+
+func TestMemDBImmutableMemtableStallsWriters(t *testing.T) {
+	opts := testOptions()
+	opts.MaxImmutableMemtables = 1
+	memDB, err := Open(t.TempDir(), opts)
+	if err != nil {
+		t.Fatalf("Error opening MemDB: %v", err)
+	}
+	defer memDB.Close()
+
+	// Hold up the background flush before it can pick a file number
+	memDB.manifest.mu.Lock()
+	for i := 0; i <= threshold; i++ {
+		if err := memDB.Set("key"+strconv.Itoa(i), "value"+strconv.Itoa(i)); err != nil {
+			t.Fatalf("Error setting key-value pair: %v", err)
+		}
+	}
+	memDB.mu.RLock()
+	immutables := len(memDB.immutables)
+	memDB.mu.RUnlock()
+	if immutables != 1 || memDB.memtable.Len() != 0 {
+		t.Fatalf("Expected the memtable to be rotated, got %d immutable memtables", immutables)
+	}
+	if result, err := memDB.Get("key0"); err != nil || result != "value0" {
+		t.Errorf("Expected value0 from the immutable memtable, got %q (%v)", result, err)
+	}
+
+	// The next rotation waits for the flush
+	done := make(chan error)
+	go func() {
+		for i := threshold + 1; i <= 2*threshold+1; i++ {
+			if err := memDB.Set("key"+strconv.Itoa(i), "value"+strconv.Itoa(i)); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("Expected the writer to stall, got %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	memDB.manifest.mu.Unlock()
+	if err := <-done; err != nil {
+		t.Fatalf("Error setting key-value pair: %v", err)
+	}
+	if err := memDB.Flush(); err != nil {
+		t.Fatalf("Error flushing memtable: %v", err)
+	}
+	if stats := memDB.Stats(); stats.ImmutableMemtables != 0 || stats.MemtableKeys != 0 || stats.LevelFiles[0] != 2 {
+		t.Errorf("Expected everything to be flushed into 2 files, got %+v", stats)
+	}
+}
+
+// blockFlushes makes the flushes into the next n SST file numbers fail, by
+// putting a directory where each file is created.
+func blockFlushes(t *testing.T, memDB *MemDB, n int) {
+	t.Helper()
+	// Numbers are handed out in order, after the one reserved here
+	next := memDB.manifest.NewFileNumber() + 1
+	for number := next; number < next+n; number++ {
+		if err := os.Mkdir(memDB.names.sst(number)+sstTempSuffix, 0755); err != nil {
+			t.Fatalf("Error creating directory: %v", err)
+		}
+	}
+}
+
+// waitForRetriedFlushes waits until the background flush has caught up
+// after failing.
+func waitForRetriedFlushes(t *testing.T, memDB *MemDB) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for memDB.waitForFlushes() != nil {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the failed flush to be retried")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestMemDBRetriesFailedFlush(t *testing.T) {
+	memDB := openTestDB(t, t.TempDir())
+	defer memDB.Close()
+
+	blockFlushes(t, memDB, 1)
+	for i := 0; i <= threshold; i++ {
+		if err := memDB.Set("key"+strconv.Itoa(i), "value"+strconv.Itoa(i)); err != nil {
+			t.Fatalf("Error setting key-value pair: %v", err)
+		}
+	}
+	if err := memDB.waitForFlushes(); err == nil {
+		t.Fatal("Expected the flush to fail, but got nil")
+	}
+
+	// Nothing else signals the background flush, it retries by itself
+	waitForRetriedFlushes(t, memDB)
+	if stats := memDB.Stats(); stats.ImmutableMemtables != 0 || stats.LevelFiles[0] != 1 {
+		t.Errorf("Expected the memtable to be flushed into 1 file, got %+v", stats)
+	}
+	if result, err := memDB.Get("key0"); err != nil || result != "value0" {
+		t.Errorf("Expected value0 after the retried flush, got %q (%v)", result, err)
+	}
+}
+
+func TestMemDBWriteFailsBeforeLogging(t *testing.T) {
+	opts := testOptions()
+	opts.MaxImmutableMemtables = 1
+	memDB, err := Open(t.TempDir(), opts)
+	if err != nil {
+		t.Fatalf("Error opening MemDB: %v", err)
+	}
+	defer memDB.Close()
+
+	// Keep the flush failing while the memtable fills up again
+	blockFlushes(t, memDB, 3)
+	for i := 0; i <= threshold; i++ {
+		if err := memDB.Set("key"+strconv.Itoa(i), "value"+strconv.Itoa(i)); err != nil {
+			t.Fatalf("Error setting key-value pair: %v", err)
+		}
+	}
+	if err := memDB.waitForFlushes(); err == nil {
+		t.Fatal("Expected the flush to fail, but got nil")
+	}
+
+	// The write that cannot rotate the full memtable fails, and only that one
+	failed := -1
+	for i := threshold + 1; i <= 3*threshold && failed < 0; i++ {
+		if err := memDB.Set("key"+strconv.Itoa(i), "value"+strconv.Itoa(i)); err != nil {
+			failed = i
+		}
+	}
+	if failed < 0 {
+		t.Fatal("Expected a write to fail while the flush fails")
+	}
+	if result, err := memDB.Get("key" + strconv.Itoa(failed)); err == nil {
+		t.Errorf("Expected the failed write not to be applied, got %q", result)
+	}
+	previous := "key" + strconv.Itoa(failed-1)
+	if result, err := memDB.Get(previous); err != nil || result != "value"+strconv.Itoa(failed-1) {
+		t.Errorf("Expected the write before it to be applied, got %q (%v)", result, err)
+	}
+
+	waitForRetriedFlushes(t, memDB)
+	if err := memDB.Set("key"+strconv.Itoa(failed), "value"); err != nil {
+		t.Fatalf("Error setting key-value pair after the flush: %v", err)
+	}
+}
+
+func TestMemDBConcurrentDel(t *testing.T) {
+	memDB := openTestDB(t, t.TempDir())
+	defer memDB.Close()
+
+	// Each key is set once and deleted by several goroutines at once: the
+	// value is returned to exactly one of them
+	for i := 0; i < 20; i++ {
+		key := "key" + strconv.Itoa(i)
+		if err := memDB.Set(key, "value"); err != nil {
+			t.Fatalf("Error setting key-value pair: %v", err)
+		}
+
+		var deleted int32
+		var wg sync.WaitGroup
+		for g := 0; g < 4; g++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if _, err := memDB.Del(key); err == nil {
+					atomic.AddInt32(&deleted, 1)
+				}
+			}()
+		}
+		wg.Wait()
+
+		if deleted != 1 {
+			t.Errorf("Expected %s to be deleted once, got %d", key, deleted)
+		}
 	}
 }
@@ -1,67 +1,565 @@
 package main
 
 import (
-	"encoding/json"
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"hash/crc32"
+	"io"
 	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 )
 
-// WAL represents the Write-Ahead Log.
+// walMagic starts every binary WAL file. Files without it are read as the
+// legacy JSON-line format and converted when the WAL is opened.
+var walMagic = []byte("KVWAL\x00\x00\x01")
+
+// SyncPolicy controls when the WAL is fsynced, and so which acknowledged
+// writes survive a power failure.
+type SyncPolicy int
+
+const (
+	// SyncAlways fsyncs before a write returns. Writers waiting at the same
+	// time share a single fsync.
+	SyncAlways SyncPolicy = iota
+	// SyncInterval fsyncs in the background at a fixed interval, so up to
+	// one interval of writes can be lost.
+	SyncInterval
+	// SyncNever leaves flushing to the operating system.
+	SyncNever
+)
+
+// WAL represents the Write-Ahead Log. The log is split into numbered
+// segment files named after the WAL filename, such as wal.000001. A new
+// segment is started whenever the memtable is rotated, and the older ones
+// are deleted once the SST file holding their records is written.
 type WAL struct {
-	file         *os.File
-	mu           sync.Mutex
-	currentIndex int // New field to track the current index
-	watermark    int // New field to track the last successfully flushed index
+	filename string
+	file     *os.File // Current segment
+	segments []int    // Live segment numbers, oldest first
+	mu       sync.Mutex
+	size     int64  // Offset right after the last intact record of the current segment
+	lastSeq  uint64 // Sequence number of the last record written
+
+	policy    SyncPolicy
+	syncMu    sync.Mutex    // Held while an fsync or a segment switch is running
+	syncedSeq uint64        // Last sequence number known to be on disk, guarded by mu
+	syncs     uint64        // Number of fsyncs issued, guarded by mu
+	stopSync  chan struct{} // Stops the background fsync of SyncInterval
+	syncDone  chan struct{}
 }
 
-// NewWAL creates a new Write-Ahead Log.
-func NewWAL(filename string) (*WAL, error) {
-	file, err := os.OpenFile(filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+// NewWAL opens the Write-Ahead Log stored in segments next to filename. The
+// live segments are read once, in order, and their intact records are passed
+// to apply, which may be nil. The last segment is cut off at its first torn
+// or corrupt record so new records always follow intact ones. A single-file
+// WAL from before segments is taken over as segment 0.
+func NewWAL(filename string, apply func(record *WALRecord)) (*WAL, error) {
+	if err := migrateJSONWAL(filename); err != nil {
+		return nil, err
+	}
+
+	segments, err := listWALSegments(filename)
 	if err != nil {
 		return nil, err
 	}
+	if _, err := os.Stat(filename); err == nil && len(segments) == 0 {
+		if err := os.Rename(filename, walSegmentName(filename, 0)); err != nil {
+			return nil, err
+		}
+		segments = []int{0}
+	}
+	if len(segments) == 0 {
+		segments = []int{1}
+	}
 
-	return &WAL{
-		file:         file,
-		currentIndex: 0, // Initialize the current index to 0
-		watermark:    0, // Initialize the watermark to 0
-	}, nil
+	wal := &WAL{
+		filename: filename,
+		segments: segments,
+	}
+	if err := wal.recover(apply); err != nil {
+		if wal.file != nil {
+			wal.file.Close()
+		}
+		return nil, err
+	}
+	return wal, nil
 }
 
-// WriteRecord writes a WALRecord to the Write-Ahead Log.
+// walSegmentName returns the file name of a WAL segment.
+func walSegmentName(filename string, segment int) string {
+	return fmt.Sprintf("%s.%06d", filename, segment)
+}
+
+// listWALSegments returns the numbers of the segment files of a WAL in
+// increasing order.
+func listWALSegments(filename string) ([]int, error) {
+	matches, err := filepath.Glob(filename + ".*")
+	if err != nil {
+		return nil, err
+	}
+
+	var segments []int
+	for _, match := range matches {
+		segment, err := strconv.Atoi(strings.TrimPrefix(match, filename+"."))
+		if err != nil || segment < 0 {
+			// Not a segment, for instance a temporary file
+			continue
+		}
+		segments = append(segments, segment)
+	}
+	sort.Ints(segments)
+	return segments, nil
+}
+
+// recover reads the records of every segment, tracking the last sequence
+// number, then opens the newest segment for appending.
+func (wal *WAL) recover(apply func(record *WALRecord)) error {
+	last := wal.segments[len(wal.segments)-1]
+	for _, segment := range wal.segments[:len(wal.segments)-1] {
+		file, err := os.Open(walSegmentName(wal.filename, segment))
+		if err != nil {
+			return err
+		}
+		_, err = wal.scanSegment(file, apply)
+		file.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	file, err := os.OpenFile(walSegmentName(wal.filename, last), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	wal.file = file
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() >= int64(len(walMagic)) {
+		if wal.size, err = wal.scanSegment(file, apply); err != nil {
+			return err
+		}
+	}
+
+	// Drop the torn tail, or start a new file with the header
+	if wal.size == 0 {
+		if err := file.Truncate(0); err != nil {
+			return err
+		}
+		if _, err := file.WriteAt(walMagic, 0); err != nil {
+			return err
+		}
+		wal.size = int64(len(walMagic))
+	} else if wal.size < info.Size() {
+		if err := file.Truncate(wal.size); err != nil {
+			return err
+		}
+	}
+	_, err = file.Seek(wal.size, io.SeekStart)
+	return err
+}
+
+// scanSegment passes the intact records of a segment to apply, tracking
+// sequence numbers, and returns where the intact records end.
+func (wal *WAL) scanSegment(file *os.File, apply func(record *WALRecord)) (int64, error) {
+	reader, err := NewWALReader(file)
+	if err != nil {
+		return 0, err
+	}
+	for {
+		record, err := reader.Next()
+		if err == io.EOF {
+			return reader.Offset(), nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		wal.lastSeq = record.lastSeq()
+		if apply != nil {
+			apply(record)
+		}
+	}
+}
+
+// SetSyncPolicy changes when the WAL is fsynced. interval is only used by
+// SyncInterval.
+func (wal *WAL) SetSyncPolicy(policy SyncPolicy, interval time.Duration) {
+	wal.stopBackgroundSync()
+
+	wal.mu.Lock()
+	wal.policy = policy
+	wal.mu.Unlock()
+
+	if policy == SyncInterval {
+		wal.stopSync = make(chan struct{})
+		wal.syncDone = make(chan struct{})
+		go wal.backgroundSync(interval, wal.stopSync, wal.syncDone)
+	}
+}
+
+func (wal *WAL) backgroundSync(interval time.Duration, stop, done chan struct{}) {
+	defer close(done)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			// A failed fsync is retried on the next tick
+			wal.Sync()
+		case <-stop:
+			return
+		}
+	}
+}
+
+func (wal *WAL) stopBackgroundSync() {
+	if wal.stopSync != nil {
+		close(wal.stopSync)
+		<-wal.syncDone
+		wal.stopSync = nil
+	}
+}
+
+// WriteRecord writes a WALRecord to the Write-Ahead Log and assigns it the
+// next sequence number. With SyncAlways it returns once the record is on
+// disk.
 func (wal *WAL) WriteRecord(record WALRecord) error {
+	if err := wal.appendRecord(&record); err != nil {
+		return err
+	}
+	return wal.waitDurable(record.lastSeq())
+}
+
+// appendRecord writes a record with the next sequence number, which is set
+// in record, without waiting for an fsync. A batch takes one sequence
+// number per operation.
+func (wal *WAL) appendRecord(record *WALRecord) error {
 	wal.mu.Lock()
 	defer wal.mu.Unlock()
 
-	// Serialize the record to JSON
-	jsonRecord, err := json.Marshal(record)
+	return wal.append(record)
+}
+
+// waitDurable returns once the record numbered seq is as durable as the
+// sync policy requires.
+func (wal *WAL) waitDurable(seq uint64) error {
+	wal.mu.Lock()
+	policy := wal.policy
+	wal.mu.Unlock()
+
+	if policy == SyncAlways {
+		return wal.syncTo(seq)
+	}
+	return nil
+}
+
+// append writes a record with the next sequence number. wal.mu must be held.
+func (wal *WAL) append(record *WALRecord) error {
+	// Serialize the record to the binary format
+	record.Seq = wal.lastSeq + 1
+	data, err := record.Encode()
 	if err != nil {
 		return err
 	}
 
-	// Append the JSON record to the WAL file
-	_, err = fmt.Fprintln(wal.file, string(jsonRecord))
-	if err != nil {
+	// Append the record to the WAL file
+	if _, err := wal.file.Write(data); err != nil {
+		// Cut off the partial record so later ones stay readable
+		wal.file.Truncate(wal.size)
+		wal.file.Seek(wal.size, io.SeekStart)
+		return err
+	}
+	wal.size += int64(len(data))
+	wal.lastSeq = record.lastSeq()
+	return nil
+}
+
+// Sync fsyncs every record written so far.
+func (wal *WAL) Sync() error {
+	wal.mu.Lock()
+	seq := wal.lastSeq
+	wal.mu.Unlock()
+
+	return wal.syncTo(seq)
+}
+
+// syncTo makes sure the log is on disk up to the record numbered seq. This
+// is a group commit: writers that arrive while an fsync is running wait for
+// it, and the first of them that is still not covered afterwards issues one
+// fsync for all the records appended in the meantime.
+func (wal *WAL) syncTo(seq uint64) error {
+	wal.syncMu.Lock()
+	defer wal.syncMu.Unlock()
+
+	wal.mu.Lock()
+	if wal.syncedSeq >= seq {
+		wal.mu.Unlock()
+		return nil
+	}
+	target, file := wal.lastSeq, wal.file
+	wal.syncs++
+	wal.mu.Unlock()
+
+	if err := file.Sync(); err != nil {
 		return err
 	}
 
+	wal.mu.Lock()
+	wal.syncedSeq = target
+	wal.mu.Unlock()
 	return nil
 }
 
-// Flush resets the current index and updates the watermark.
-func (wal *WAL) Flush() {
+// LastSeq returns the sequence number of the last record written.
+func (wal *WAL) LastSeq() uint64 {
+	wal.mu.Lock()
+	defer wal.mu.Unlock()
+
+	return wal.lastSeq
+}
+
+// advanceSeq makes sure new records are numbered after seq. Records whose
+// segments were deleted after a flush are known to the MANIFEST only.
+func (wal *WAL) advanceSeq(seq uint64) {
 	wal.mu.Lock()
 	defer wal.mu.Unlock()
 
-	// Update the watermark to the current index
-	wal.watermark = wal.currentIndex
+	if seq > wal.lastSeq {
+		wal.lastSeq = seq
+		wal.syncedSeq = seq
+	}
+}
+
+// Flush starts a new segment and deletes the older ones, for a caller that
+// has stored every record so far elsewhere. The store rotates and releases
+// segments separately, so records written in between are kept.
+func (wal *WAL) Flush() error {
+	segment, _, err := wal.Rotate()
+	if err != nil {
+		return err
+	}
+	return wal.Release(segment)
+}
+
+// Rotate syncs the current segment and starts the next one, so the records
+// written so far can be released on their own once they are flushed. It
+// returns the number of the new segment and the sequence number of the last
+// record before it.
+func (wal *WAL) Rotate() (int, uint64, error) {
+	// Keep fsyncs away while the current segment changes
+	wal.syncMu.Lock()
+	defer wal.syncMu.Unlock()
+	wal.mu.Lock()
+	defer wal.mu.Unlock()
+
+	if err := wal.file.Sync(); err != nil {
+		return 0, 0, err
+	}
+
+	segment := wal.segments[len(wal.segments)-1] + 1
+	file, err := os.OpenFile(walSegmentName(wal.filename, segment), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return 0, 0, err
+	}
+	if _, err := file.Write(walMagic); err != nil {
+		file.Close()
+		return 0, 0, err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return 0, 0, err
+	}
 
-	// Reset the current index
-	wal.currentIndex++
+	wal.file.Close()
+	wal.file = file
+	wal.size = int64(len(walMagic))
+	wal.segments = append(wal.segments, segment)
+	wal.syncedSeq = wal.lastSeq
+	wal.syncs++
+	return segment, wal.lastSeq, nil
 }
 
-// Close closes the Write-Ahead Log file.
+// Release deletes the segments numbered before segment, once their records
+// are stored in SST files. The current segment is always kept.
+func (wal *WAL) Release(segment int) error {
+	wal.mu.Lock()
+	var obsolete []int
+	for len(wal.segments) > 1 && wal.segments[0] < segment {
+		obsolete = append(obsolete, wal.segments[0])
+		wal.segments = wal.segments[1:]
+	}
+	wal.mu.Unlock()
+
+	// Delete the oldest first, so a crash never leaves a gap
+	for _, segment := range obsolete {
+		if err := os.Remove(walSegmentName(wal.filename, segment)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close syncs and closes the Write-Ahead Log file.
 func (wal *WAL) Close() error {
+	wal.stopBackgroundSync()
+	if wal.policy != SyncNever {
+		if err := wal.Sync(); err != nil {
+			wal.file.Close()
+			return err
+		}
+	}
 	return wal.file.Close()
 }
+
+// WALReader reads records from a binary WAL file in order.
+type WALReader struct {
+	r      *bufio.Reader
+	offset int64
+}
+
+// NewWALReader reads and checks the header of a binary WAL file.
+func NewWALReader(r io.Reader) (*WALReader, error) {
+	reader := &WALReader{r: bufio.NewReader(r)}
+
+	header := make([]byte, len(walMagic))
+	if _, err := io.ReadFull(reader.r, header); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(header, walMagic) {
+		return nil, errors.New("Invalid WAL file format")
+	}
+	reader.offset = int64(len(walMagic))
+	return reader, nil
+}
+
+// Next returns the next record. It returns io.EOF at the end of the log and
+// also at the first torn or corrupt record, since nothing after a damaged
+// record can be trusted.
+func (wr *WALReader) Next() (*WALRecord, error) {
+	payload, err := readFrame(wr.r)
+	if err != nil {
+		return nil, err
+	}
+
+	record, err := decodeWALPayload(payload)
+	if err != nil {
+		return nil, io.EOF
+	}
+	wr.offset += int64(walHeaderSize) + int64(len(payload))
+	return record, nil
+}
+
+// frame prefixes payload with its length and CRC32C.
+func frame(payload []byte) []byte {
+	data := make([]byte, walHeaderSize+len(payload))
+	binary.LittleEndian.PutUint32(data[0:], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(data[4:], crc32.Checksum(payload, crc32cTable))
+	copy(data[walHeaderSize:], payload)
+	return data
+}
+
+// readFrame reads a payload written by frame. It returns io.EOF at the end
+// of r and at the first torn or corrupt frame.
+func readFrame(r *bufio.Reader) ([]byte, error) {
+	header := make([]byte, walHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, io.EOF
+		}
+		return nil, err
+	}
+	length := binary.LittleEndian.Uint32(header[0:])
+	checksum := binary.LittleEndian.Uint32(header[4:])
+
+	// Read what is there rather than trusting a possibly corrupt length
+	payload, err := io.ReadAll(io.LimitReader(r, int64(length)))
+	if err != nil {
+		return nil, err
+	}
+	if len(payload) < int(length) || crc32.Checksum(payload, crc32cTable) != checksum {
+		return nil, io.EOF
+	}
+	return payload, nil
+}
+
+// Offset returns the position right after the last record returned by Next.
+func (wr *WALReader) Offset() int64 {
+	return wr.offset
+}
+
+// migrateJSONWAL rewrites a WAL in the legacy JSON-line format, where every
+// line holds one record, in the binary format. Records are read up to the
+// first line that does not parse and are numbered in order.
+func migrateJSONWAL(filename string) error {
+	file, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	r := bufio.NewReader(file)
+	head, _ := r.Peek(len(walMagic))
+	if len(head) == 0 || bytes.HasPrefix(walMagic, head) {
+		// Empty or already binary
+		return nil
+	}
+
+	tmpname := filename + ".tmp"
+	out, err := os.Create(tmpname)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpname)
+	defer out.Close()
+
+	w := bufio.NewWriter(out)
+	if _, err := w.Write(walMagic); err != nil {
+		return err
+	}
+	var seq uint64
+	for {
+		line, readErr := r.ReadBytes('\n')
+		if line = bytes.TrimSpace(line); len(line) > 0 {
+			record, err := Deserialize(line)
+			if err != nil {
+				break
+			}
+			seq++
+			record.Seq = seq
+			data, err := record.Encode()
+			if err != nil {
+				break
+			}
+			if _, err := w.Write(data); err != nil {
+				return err
+			}
+		}
+		if readErr != nil {
+			break
+		}
+	}
+
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpname, filename)
+}
@@ -3,7 +3,9 @@
 package main
 
 import (
+	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"time"
 )
 
@@ -11,6 +13,33 @@ import (
 const (
 	SetOperation = "Set"
 	DelOperation = "Del"
+
+	// BatchOperation holds the Set and Del records of a WriteBatch, which
+	// are replayed all together or not at all.
+	BatchOperation = "Batch"
+)
+
+// Record types stored in the binary WAL format
+const (
+	walRecordSet   byte = 1
+	walRecordDel   byte = 2
+	walRecordBatch byte = 4
+
+	// walRecordSetTTL is a Set whose value expires. Its expiry time
+	// follows the payload header, or the header of a batch operation.
+	walRecordSetTTL byte = 5
+)
+
+// walHeaderSize is the size of the length and CRC in front of every binary
+// record, walPayloadHeaderSize the size of the type, sequence number and key
+// length that start its payload, walBatchOpHeaderSize the size of the type,
+// key length and value length in front of every operation of a batch, and
+// walExpirySize the size of the expiry time of a walRecordSetTTL.
+const (
+	walHeaderSize        = 4 + 4
+	walPayloadHeaderSize = 1 + 8 + 4
+	walBatchOpHeaderSize = 1 + 4 + 4
+	walExpirySize        = 8
 )
 
 // WALRecord represents a record in the Write-Ahead Log.
@@ -18,7 +47,24 @@ type WALRecord struct {
 	Operation string    `json:"operation"`
 	Key       string    `json:"key"`
 	Value     string    `json:"value,omitempty"`
+	Seq       uint64    `json:"seq,omitempty"`
 	Timestamp time.Time `json:"timestamp"`
+
+	// ExpiresAt is the Unix time in nanoseconds at which the value of a Set
+	// expires, 0 if it never does.
+	ExpiresAt int64 `json:"expires_at,omitempty"`
+
+	// Batch holds the records of a BatchOperation. They are numbered from
+	// Seq on, in order.
+	Batch []WALRecord `json:"batch,omitempty"`
+}
+
+// lastSeq returns the sequence number of the last write in the record.
+func (r *WALRecord) lastSeq() uint64 {
+	if r.Operation == BatchOperation && len(r.Batch) > 0 {
+		return r.Seq + uint64(len(r.Batch)) - 1
+	}
+	return r.Seq
 }
 
 // NewWALRecord creates a new WALRecord.
@@ -46,6 +92,165 @@ func (r *WALRecord) Serialize() ([]byte, error) {
 	return json.Marshal(r)
 }
 
+// Encode returns the binary form of the record: the payload length, the
+// CRC32C of the payload, then the payload itself made of the record type,
+// the sequence number, the key length, the expiry time of a value that
+// expires, the key and the value. The timestamp is only kept by the legacy
+// JSON format.
+//
+// A batch has the number of its operations in place of the key length,
+// followed by the type, key length, value length, expiry time if any, key
+// and value of every operation. The checksum covers the whole batch.
+func (r *WALRecord) Encode() ([]byte, error) {
+	if r.Operation == BatchOperation {
+		return r.encodeBatch()
+	}
+	recordType, err := walRecordType(r)
+	if err != nil {
+		return nil, err
+	}
+
+	headerSize := walPayloadHeaderSize
+	if recordType == walRecordSetTTL {
+		headerSize += walExpirySize
+	}
+	payload := make([]byte, headerSize+len(r.Key)+len(r.Value))
+	payload[0] = recordType
+	binary.LittleEndian.PutUint64(payload[1:], r.Seq)
+	binary.LittleEndian.PutUint32(payload[9:], uint32(len(r.Key)))
+	if recordType == walRecordSetTTL {
+		binary.LittleEndian.PutUint64(payload[walPayloadHeaderSize:], uint64(r.ExpiresAt))
+	}
+	copy(payload[headerSize:], r.Key)
+	copy(payload[headerSize+len(r.Key):], r.Value)
+
+	return frame(payload), nil
+}
+
+func walRecordType(r *WALRecord) (byte, error) {
+	switch r.Operation {
+	case SetOperation:
+		if r.ExpiresAt != 0 {
+			return walRecordSetTTL, nil
+		}
+		return walRecordSet, nil
+	case DelOperation:
+		return walRecordDel, nil
+	}
+	return 0, errors.New("unknown WAL operation " + r.Operation)
+}
+
+func (r *WALRecord) encodeBatch() ([]byte, error) {
+	size := walPayloadHeaderSize
+	for _, op := range r.Batch {
+		size += walBatchOpHeaderSize + walExpirySize + len(op.Key) + len(op.Value)
+	}
+
+	payload := make([]byte, walPayloadHeaderSize, size)
+	payload[0] = walRecordBatch
+	binary.LittleEndian.PutUint64(payload[1:], r.Seq)
+	binary.LittleEndian.PutUint32(payload[9:], uint32(len(r.Batch)))
+	for _, op := range r.Batch {
+		if op.Operation != SetOperation && op.Operation != DelOperation {
+			return nil, errors.New("unknown WAL batch operation " + op.Operation)
+		}
+		opType, _ := walRecordType(&op)
+		payload = append(payload, opType)
+		payload = binary.LittleEndian.AppendUint32(payload, uint32(len(op.Key)))
+		payload = binary.LittleEndian.AppendUint32(payload, uint32(len(op.Value)))
+		if opType == walRecordSetTTL {
+			payload = binary.LittleEndian.AppendUint64(payload, uint64(op.ExpiresAt))
+		}
+		payload = append(payload, op.Key...)
+		payload = append(payload, op.Value...)
+	}
+	return frame(payload), nil
+}
+
+// decodeWALBatch decodes the operations of a batch payload.
+func decodeWALBatch(record *WALRecord, count uint32, rest []byte) error {
+	if uint64(count) > uint64(len(rest)/walBatchOpHeaderSize) {
+		return errors.New("WAL batch count out of range")
+	}
+	record.Batch = make([]WALRecord, count)
+	for i := range record.Batch {
+		if len(rest) < walBatchOpHeaderSize {
+			return errors.New("WAL batch operation too short")
+		}
+		op := &record.Batch[i]
+		opType := rest[0]
+		switch opType {
+		case walRecordSet, walRecordSetTTL:
+			op.Operation = SetOperation
+		case walRecordDel:
+			op.Operation = DelOperation
+		default:
+			return errors.New("unknown WAL batch operation type")
+		}
+		keyLength := uint64(binary.LittleEndian.Uint32(rest[1:]))
+		valueLength := uint64(binary.LittleEndian.Uint32(rest[5:]))
+		rest = rest[walBatchOpHeaderSize:]
+		if opType == walRecordSetTTL {
+			if len(rest) < walExpirySize {
+				return errors.New("WAL batch operation too short")
+			}
+			op.ExpiresAt = int64(binary.LittleEndian.Uint64(rest))
+			rest = rest[walExpirySize:]
+		}
+		if keyLength+valueLength > uint64(len(rest)) {
+			return errors.New("WAL batch operation length out of range")
+		}
+		op.Key = string(rest[:keyLength])
+		op.Value = string(rest[keyLength : keyLength+valueLength])
+		op.Seq = record.Seq + uint64(i)
+		rest = rest[keyLength+valueLength:]
+	}
+	if len(rest) > 0 {
+		return errors.New("WAL batch has trailing bytes")
+	}
+	return nil
+}
+
+// decodeWALPayload decodes the payload of a binary record whose checksum
+// has already been verified.
+func decodeWALPayload(payload []byte) (*WALRecord, error) {
+	if len(payload) < walPayloadHeaderSize {
+		return nil, errors.New("WAL record too short")
+	}
+
+	record := &WALRecord{Seq: binary.LittleEndian.Uint64(payload[1:])}
+	rest := payload[walPayloadHeaderSize:]
+	switch payload[0] {
+	case walRecordSet:
+		record.Operation = SetOperation
+	case walRecordSetTTL:
+		record.Operation = SetOperation
+		if len(rest) < walExpirySize {
+			return nil, errors.New("WAL record too short")
+		}
+		record.ExpiresAt = int64(binary.LittleEndian.Uint64(rest))
+		rest = rest[walExpirySize:]
+	case walRecordDel:
+		record.Operation = DelOperation
+	case walRecordBatch:
+		record.Operation = BatchOperation
+		if err := decodeWALBatch(record, binary.LittleEndian.Uint32(payload[9:]), rest); err != nil {
+			return nil, err
+		}
+		return record, nil
+	default:
+		return nil, errors.New("unknown WAL record type")
+	}
+
+	keyLength := binary.LittleEndian.Uint32(payload[9:])
+	if uint64(keyLength) > uint64(len(rest)) {
+		return nil, errors.New("WAL record key length out of range")
+	}
+	record.Key = string(rest[:keyLength])
+	record.Value = string(rest[keyLength:])
+	return record, nil
+}
+
 // Deserialize deserializes JSON data into a WALRecord.
 func Deserialize(data []byte) (*WALRecord, error) {
 	var record WALRecord
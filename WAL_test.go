@@ -1,21 +1,19 @@
 package main
 
 import (
-	"io/ioutil"
+	"io"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
 
 func TestWALWriteRecord(t *testing.T) {
-	// Create a temporary WAL file for testing
-	tmpfile, err := ioutil.TempFile("", "wal_test")
-	if err != nil {
-		t.Fatalf("Error creating temporary WAL file: %v", err)
-	}
-	defer os.Remove(tmpfile.Name()) // Clean up the temporary file
-
-	wal, err := NewWAL(tmpfile.Name())
+	// Create the WAL segments in a temporary directory for testing
+	wal, err := NewWAL(filepath.Join(t.TempDir(), "wal"), nil)
 	if err != nil {
 		t.Fatalf("Error creating WAL: %v", err)
 	}
@@ -35,18 +33,12 @@ func TestWALWriteRecord(t *testing.T) {
 }
 
 func TestWALFlush(t *testing.T) {
-	// Create a temporary WAL file for testing
-	tmpfile, err := ioutil.TempFile("", "wal_test")
-	if err != nil {
-		t.Fatalf("Error creating temporary WAL file: %v", err)
-	}
-	defer os.Remove(tmpfile.Name()) // Clean up the temporary file
-
-	wal, err := NewWAL(tmpfile.Name())
+	// Create the WAL segments in a temporary directory for testing
+	filename := filepath.Join(t.TempDir(), "wal")
+	wal, err := NewWAL(filename, nil)
 	if err != nil {
 		t.Fatalf("Error creating WAL: %v", err)
 	}
-	defer wal.Close()
 
 	// Write a record to the WAL
 	record := WALRecord{
@@ -61,10 +53,362 @@ func TestWALFlush(t *testing.T) {
 	}
 
 	// Flush the WAL
-	wal.Flush()
+	if err := wal.Flush(); err != nil {
+		t.Fatalf("Error flushing WAL: %v", err)
+	}
+
+	// Check that only the records after the flush are replayed
+	if err := wal.WriteRecord(NewSetWALRecord("afterFlush", "value")); err != nil {
+		t.Fatalf("Error writing record to WAL: %v", err)
+	}
+	wal.Close()
+	var replayed []string
+	wal, err = NewWAL(filename, func(record *WALRecord) {
+		replayed = append(replayed, record.Key)
+	})
+	if err != nil {
+		t.Fatalf("Error reopening WAL: %v", err)
+	}
+	defer wal.Close()
+	if len(replayed) != 1 || replayed[0] != "afterFlush" {
+		t.Errorf("Expected only the record after the flush, got %v", replayed)
+	}
+}
+
+// readAllWALRecords returns every intact record of a binary WAL file.
+func readAllWALRecords(t *testing.T, filename string) []*WALRecord {
+	t.Helper()
+	file, err := os.Open(filename)
+	if err != nil {
+		t.Fatalf("Error opening WAL file: %v", err)
+	}
+	defer file.Close()
+
+	reader, err := NewWALReader(file)
+	if err != nil {
+		t.Fatalf("Error reading WAL header: %v", err)
+	}
+	var records []*WALRecord
+	for {
+		record, err := reader.Next()
+		if err == io.EOF {
+			return records
+		}
+		if err != nil {
+			t.Fatalf("Error reading WAL record: %v", err)
+		}
+		records = append(records, record)
+	}
+}
+
+func TestWALBinaryRecords(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "wal")
+	wal, err := NewWAL(filename, nil)
+	if err != nil {
+		t.Fatalf("Error creating WAL: %v", err)
+	}
+
+	// Values with arbitrary bytes and values larger than a scanner line
+	binaryValue := make([]byte, 256)
+	for i := range binaryValue {
+		binaryValue[i] = byte(i)
+	}
+	written := []WALRecord{
+		{Operation: SetOperation, Key: "binary", Value: string(binaryValue)},
+		{Operation: SetOperation, Key: "large", Value: strings.Repeat("x", 100*1024)},
+		{Operation: SetOperation, Key: "line\nbreak", Value: "{\"json\": true}\n"},
+		{Operation: DelOperation, Key: "binary"},
+	}
+	for _, record := range written {
+		if err := wal.WriteRecord(record); err != nil {
+			t.Fatalf("Error writing record to WAL: %v", err)
+		}
+	}
+	wal.Close()
+
+	records := readAllWALRecords(t, walSegmentName(filename, 1))
+	if len(records) != len(written) {
+		t.Fatalf("Expected %d records, got %d", len(written), len(records))
+	}
+	for i, record := range records {
+		if record.Operation != written[i].Operation || record.Key != written[i].Key || record.Value != written[i].Value {
+			t.Errorf("Record %d: expected %s %q, got %s %q", i, written[i].Operation, written[i].Key, record.Operation, record.Key)
+		}
+		if record.Seq != uint64(i+1) {
+			t.Errorf("Record %d: expected sequence number %d, got %d", i, i+1, record.Seq)
+		}
+	}
+}
+
+func TestWALExpiringRecords(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "wal")
+	wal, err := NewWAL(filename, nil)
+	if err != nil {
+		t.Fatalf("Error creating WAL: %v", err)
+	}
+
+	expiresAt := time.Now().Add(time.Hour).UnixNano()
+	batch := NewWALRecord(BatchOperation, "", "")
+	batch.Batch = []WALRecord{
+		{Operation: SetOperation, Key: "plain", Value: "value"},
+		{Operation: SetOperation, Key: "session", Value: "value", ExpiresAt: expiresAt + 1},
+		{Operation: DelOperation, Key: "plain"},
+	}
+	for _, record := range []WALRecord{
+		{Operation: SetOperation, Key: "session", Value: "value", ExpiresAt: expiresAt},
+		batch,
+	} {
+		if err := wal.WriteRecord(record); err != nil {
+			t.Fatalf("Error writing record to WAL: %v", err)
+		}
+	}
+	wal.Close()
+
+	records := readAllWALRecords(t, walSegmentName(filename, 1))
+	if len(records) != 2 {
+		t.Fatalf("Expected 2 records, got %d", len(records))
+	}
+	if record := records[0]; record.Key != "session" || record.Value != "value" || record.ExpiresAt != expiresAt {
+		t.Errorf("Expected the expiry time to be kept, got %+v", record)
+	}
+	ops := records[1].Batch
+	if len(ops) != 3 || ops[0].ExpiresAt != 0 || ops[1].ExpiresAt != expiresAt+1 || ops[1].Value != "value" || ops[2].Operation != DelOperation {
+		t.Errorf("Expected the batch to keep its expiry times, got %+v", ops)
+	}
+}
+
+func TestWALTornRecord(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "wal")
+	wal, err := NewWAL(filename, nil)
+	if err != nil {
+		t.Fatalf("Error creating WAL: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := wal.WriteRecord(NewSetWALRecord("key", "value")); err != nil {
+			t.Fatalf("Error writing record to WAL: %v", err)
+		}
+	}
+	wal.Close()
+
+	// Tear the last record in half
+	segment := walSegmentName(filename, 1)
+	info, err := os.Stat(segment)
+	if err != nil {
+		t.Fatalf("Error reading WAL size: %v", err)
+	}
+	if err := os.Truncate(segment, info.Size()-5); err != nil {
+		t.Fatalf("Error truncating WAL: %v", err)
+	}
+	if records := readAllWALRecords(t, segment); len(records) != 2 {
+		t.Fatalf("Expected replay to stop after 2 intact records, got %d", len(records))
+	}
+
+	// Reopening cuts off the torn record and keeps numbering after the last intact one
+	wal, err = NewWAL(filename, nil)
+	if err != nil {
+		t.Fatalf("Error reopening WAL: %v", err)
+	}
+	if err := wal.WriteRecord(NewSetWALRecord("after", "tear")); err != nil {
+		t.Fatalf("Error writing record to WAL: %v", err)
+	}
+	wal.Close()
+
+	records := readAllWALRecords(t, segment)
+	if len(records) != 3 || records[2].Key != "after" || records[2].Seq != 3 {
+		t.Fatalf("Expected the new record to follow the intact ones, got %d records", len(records))
+	}
+}
+
+func TestWALMigratesJSONLines(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "wal")
+	legacy := `{"operation":"Set","key":"mohi","value":"ayvalidi","timestamp":"0001-01-01T00:00:00Z"}
+{"operation":"Del","key":"mohi","timestamp":"0001-01-01T00:00:00Z"}
+{"operation":"Set","key":"moha","value":"farid","timestamp":"0001-01-01T00:00:00Z"}
+{"operation":"Set","key":"tor`
+	if err := os.WriteFile(filename, []byte(legacy), 0644); err != nil {
+		t.Fatalf("Error writing legacy WAL: %v", err)
+	}
 
-	// Check if the current index is incremented
-	if wal.currentIndex != 1 {
-		t.Errorf("Expected current index to be 1 after flush, got %d", wal.currentIndex)
+	wal, err := NewWAL(filename, nil)
+	if err != nil {
+		t.Fatalf("Error opening legacy WAL: %v", err)
+	}
+	if err := wal.WriteRecord(NewSetWALRecord("new", "record")); err != nil {
+		t.Fatalf("Error writing record to WAL: %v", err)
+	}
+	wal.Close()
+
+	// The single-file WAL becomes the first segment
+	if _, err := os.Stat(filename); !os.IsNotExist(err) {
+		t.Errorf("Expected the single-file WAL to be taken over as a segment, got %v", err)
+	}
+	records := readAllWALRecords(t, walSegmentName(filename, 0))
+	expected := []string{"Set mohi", "Del mohi", "Set moha", "Set new"}
+	if len(records) != len(expected) {
+		t.Fatalf("Expected %d records after migration, got %d", len(expected), len(records))
+	}
+	for i, record := range records {
+		if got := record.Operation + " " + record.Key; got != expected[i] {
+			t.Errorf("Record %d: expected %s, got %s", i, expected[i], got)
+		}
+	}
+}
+
+func TestWALGroupCommit(t *testing.T) {
+	wal, err := NewWAL(filepath.Join(t.TempDir(), "wal"), nil)
+	if err != nil {
+		t.Fatalf("Error creating WAL: %v", err)
+	}
+	defer wal.Close()
+	wal.SetSyncPolicy(SyncAlways, 0)
+
+	// Hold the fsync so every writer queues up behind it
+	const writers = 20
+	wal.syncMu.Lock()
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := wal.WriteRecord(NewSetWALRecord("key"+strconv.Itoa(i), "value")); err != nil {
+				t.Errorf("Error writing record to WAL: %v", err)
+			}
+		}(i)
+	}
+	for {
+		wal.mu.Lock()
+		written := wal.lastSeq
+		wal.mu.Unlock()
+		if written == writers {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	wal.syncMu.Unlock()
+	wg.Wait()
+
+	wal.mu.Lock()
+	defer wal.mu.Unlock()
+	if wal.syncs != 1 {
+		t.Errorf("Expected queued writers to share 1 fsync, got %d", wal.syncs)
+	}
+	if wal.syncedSeq != wal.lastSeq {
+		t.Errorf("Expected the whole log to be synced, synced %d of %d records", wal.syncedSeq, wal.lastSeq)
+	}
+}
+
+func TestWALSyncInterval(t *testing.T) {
+	wal, err := NewWAL(filepath.Join(t.TempDir(), "wal"), nil)
+	if err != nil {
+		t.Fatalf("Error creating WAL: %v", err)
+	}
+	defer wal.Close()
+	wal.SetSyncPolicy(SyncInterval, 10*time.Millisecond)
+
+	if err := wal.WriteRecord(NewSetWALRecord("key", "value")); err != nil {
+		t.Fatalf("Error writing record to WAL: %v", err)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		wal.mu.Lock()
+		synced := wal.syncedSeq == wal.lastSeq
+		wal.mu.Unlock()
+		if synced {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the background fsync to cover the record")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestWALSegmentRotation(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "wal")
+	wal, err := NewWAL(filename, nil)
+	if err != nil {
+		t.Fatalf("Error creating WAL: %v", err)
+	}
+
+	if err := wal.WriteRecord(NewSetWALRecord("flushed", "value")); err != nil {
+		t.Fatalf("Error writing record to WAL: %v", err)
+	}
+	if err := wal.Flush(); err != nil {
+		t.Fatalf("Error flushing WAL: %v", err)
+	}
+	if err := wal.WriteRecord(NewSetWALRecord("live", "value")); err != nil {
+		t.Fatalf("Error writing record to WAL: %v", err)
+	}
+	wal.Close()
+
+	// The first segment only held flushed records and is gone
+	segments, err := listWALSegments(filename)
+	if err != nil {
+		t.Fatalf("Error listing WAL segments: %v", err)
+	}
+	if len(segments) != 1 || segments[0] != 2 {
+		t.Fatalf("Expected only segment 2 to be left, got %v", segments)
+	}
+
+	var replayed []string
+	wal, err = NewWAL(filename, func(record *WALRecord) {
+		replayed = append(replayed, record.Operation+" "+record.Key)
+	})
+	if err != nil {
+		t.Fatalf("Error reopening WAL: %v", err)
+	}
+	defer wal.Close()
+	if wal.lastSeq != 2 {
+		t.Errorf("Expected sequence number 2 after reopening, got %d", wal.lastSeq)
+	}
+	if strings.Join(replayed, ",") != "Set live" {
+		t.Errorf("Expected only the live record, got %v", replayed)
+	}
+}
+
+func TestWALReleaseKeepsUnflushedSegments(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "wal")
+	wal, err := NewWAL(filename, nil)
+	if err != nil {
+		t.Fatalf("Error creating WAL: %v", err)
+	}
+
+	// Two rotated memtables, the first of them flushed
+	var rotations []int
+	for _, key := range []string{"first", "second"} {
+		if err := wal.WriteRecord(NewSetWALRecord(key, "value")); err != nil {
+			t.Fatalf("Error writing record to WAL: %v", err)
+		}
+		segment, lastSeq, err := wal.Rotate()
+		if err != nil {
+			t.Fatalf("Error rotating WAL: %v", err)
+		}
+		if lastSeq != wal.lastSeq {
+			t.Errorf("Expected rotation after sequence number %d, got %d", wal.lastSeq, lastSeq)
+		}
+		rotations = append(rotations, segment)
+	}
+	if err := wal.WriteRecord(NewSetWALRecord("third", "value")); err != nil {
+		t.Fatalf("Error writing record to WAL: %v", err)
+	}
+	if err := wal.Release(rotations[0]); err != nil {
+		t.Fatalf("Error releasing WAL segments: %v", err)
+	}
+	wal.Close()
+
+	var replayed []string
+	wal, err = NewWAL(filename, func(record *WALRecord) {
+		replayed = append(replayed, record.Key)
+	})
+	if err != nil {
+		t.Fatalf("Error reopening WAL: %v", err)
+	}
+	defer wal.Close()
+	if strings.Join(replayed, ",") != "second,third" {
+		t.Errorf("Expected the records after the first rotation, got %v", replayed)
+	}
+	if _, err := os.Stat(walSegmentName(filename, 1)); !os.IsNotExist(err) {
+		t.Errorf("Expected the released segment to be deleted, got %v", err)
 	}
 }
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"math"
+	"time"
+)
+
+// WriteBatch groups sets and deletes that are applied atomically by
+// MemDB.Write: they are logged as a single WAL record, take consecutive
+// sequence numbers, and become visible to readers all at once. A batch is
+// not safe for concurrent use.
+type WriteBatch struct {
+	records []WALRecord
+}
+
+// NewWriteBatch returns an empty batch.
+func NewWriteBatch() *WriteBatch {
+	return &WriteBatch{}
+}
+
+// Set adds a write of value for key.
+func (b *WriteBatch) Set(key, value string) {
+	b.records = append(b.records, WALRecord{Operation: SetOperation, Key: key, Value: value})
+}
+
+// SetWithTTL adds a write of value for key that expires after ttl, counted
+// from this call, as with MemDB.SetWithTTL. A ttl of zero or less never
+// expires, and one too long for MemDB.SetWithTTL expires at the latest time
+// it can hold.
+func (b *WriteBatch) SetWithTTL(key, value string, ttl time.Duration) {
+	record := WALRecord{Operation: SetOperation, Key: key, Value: value}
+	if ttl > 0 {
+		expiresAt, ok := expiryAfter(time.Now(), ttl)
+		if !ok {
+			expiresAt = math.MaxInt64
+		}
+		record.ExpiresAt = expiresAt
+	}
+	b.records = append(b.records, record)
+}
+
+// Del adds a delete of key. Unlike MemDB.Del it does not check that the key
+// exists.
+func (b *WriteBatch) Del(key string) {
+	b.records = append(b.records, WALRecord{Operation: DelOperation, Key: key})
+}
+
+// Len returns the number of operations in the batch.
+func (b *WriteBatch) Len() int {
+	return len(b.records)
+}
+
+// Reset empties the batch so it can be reused.
+func (b *WriteBatch) Reset() {
+	b.records = b.records[:0]
+}
+
+// Write applies every operation of batch, in order, or none of them. Later
+// operations on a key win over earlier ones. It returns once the batch is as
+// durable as the WAL sync policy requires.
+func (mem *MemDB) Write(batch *WriteBatch) error {
+	_, err := mem.writeIf(batch, nil)
+	return err
+}
+
+// writeIf writes batch if check, which may be nil, returns nil, and returns
+// the sequence number of the last write in it. check runs under the writer
+// lock, so no other write comes in between it and the batch.
+func (mem *MemDB) writeIf(batch *WriteBatch, check func() error) (uint64, error) {
+	if batch.Len() == 0 {
+		return 0, nil
+	}
+	record := NewWALRecord(BatchOperation, "", "")
+	record.Batch = append([]WALRecord(nil), batch.records...)
+
+	mem.writeMu.Lock()
+	if check != nil {
+		if err := check(); err != nil {
+			mem.writeMu.Unlock()
+			return 0, err
+		}
+	}
+	seq, err := mem.write(record)
+	mem.writeMu.Unlock()
+	if err != nil {
+		return 0, err
+	}
+	return seq, mem.wal.waitDurable(seq)
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestWriteBatch(t *testing.T) {
+	memDB := openTestDB(t, t.TempDir())
+	defer memDB.Close()
+
+	if err := memDB.Set("gone", "value"); err != nil {
+		t.Fatalf("Error setting key-value pair: %v", err)
+	}
+	before := memDB.Snapshot()
+	defer before.Release()
+
+	batch := NewWriteBatch()
+	batch.Set("a", "1")
+	batch.Set("b", "2")
+	batch.Del("gone")
+	batch.Set("a", "3")
+	if err := memDB.Write(batch); err != nil {
+		t.Fatalf("Error writing batch: %v", err)
+	}
+
+	// Operations take consecutive sequence numbers, and the last one on a key wins
+	if seq := memDB.Snapshot().Seq(); seq != before.Seq()+4 {
+		t.Errorf("Expected the batch to take 4 sequence numbers after %d, got %d", before.Seq(), seq)
+	}
+	for key, value := range map[string]string{"a": "3", "b": "2"} {
+		if result, err := memDB.Get(key); err != nil || result != value {
+			t.Errorf("Expected %s for %s, got %q (%v)", value, key, result, err)
+		}
+	}
+	if _, err := memDB.Get("gone"); err == nil {
+		t.Error("Expected the batch to delete gone")
+	}
+	if _, err := before.Get("a"); err == nil {
+		t.Error("Expected the batch to be invisible to an older snapshot")
+	}
+}
+
+func TestWriteBatchIsSeenAllAtOnce(t *testing.T) {
+	memDB := openTestDB(t, t.TempDir())
+	defer memDB.Close()
+
+	// Readers must never see one key of a batch without the other
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				snap := memDB.Snapshot()
+				a, errA := snap.Get("a")
+				b, errB := snap.Get("b")
+				snap.Release()
+				if (errA == nil) != (errB == nil) || a != b {
+					t.Errorf("Expected a and b from the same batch, got %q (%v) and %q (%v)", a, errA, b, errB)
+					return
+				}
+			}
+		}()
+	}
+
+	for i := 0; i < 50; i++ {
+		batch := NewWriteBatch()
+		batch.Set("a", strconv.Itoa(i))
+		batch.Set("b", strconv.Itoa(i))
+		if err := memDB.Write(batch); err != nil {
+			t.Fatalf("Error writing batch: %v", err)
+		}
+	}
+	close(done)
+	wg.Wait()
+}
+
+func TestWriteBatchRecoversAllOrNothing(t *testing.T) {
+	// The default memtable is large enough to keep both batches in one segment
+	dir := t.TempDir()
+	memDB, err := Open(dir, DefaultOptions())
+	if err != nil {
+		t.Fatalf("Error opening MemDB: %v", err)
+	}
+
+	batch := NewWriteBatch()
+	batch.Set("first", "1")
+	batch.Set("second", "2")
+	if err := memDB.Write(batch); err != nil {
+		t.Fatalf("Error writing batch: %v", err)
+	}
+	batch.Reset()
+	batch.Set("third", "3")
+	batch.Set("fourth", "4")
+	if err := memDB.Write(batch); err != nil {
+		t.Fatalf("Error writing batch: %v", err)
+	}
+	segment := memDB.wal.file.Name()
+	memDB.Close()
+
+	// Tear the second batch: neither of its writes may come back
+	info, err := os.Stat(segment)
+	if err != nil {
+		t.Fatalf("Error reading WAL size: %v", err)
+	}
+	if err := os.Truncate(segment, info.Size()-3); err != nil {
+		t.Fatalf("Error truncating WAL: %v", err)
+	}
+
+	memDB, err = Open(dir, DefaultOptions())
+	if err != nil {
+		t.Fatalf("Error reopening MemDB: %v", err)
+	}
+	defer memDB.Close()
+	for key, value := range map[string]string{"first": "1", "second": "2"} {
+		if result, err := memDB.Get(key); err != nil || result != value {
+			t.Errorf("Expected %s for %s after restart, got %q (%v)", value, key, result, err)
+		}
+	}
+	for _, key := range []string{"third", "fourth"} {
+		if result, err := memDB.Get(key); err == nil {
+			t.Errorf("Expected %s of the torn batch to be missing, got %q", key, result)
+		}
+	}
+}
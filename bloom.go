@@ -0,0 +1,73 @@
+package main
+
+import (
+	"hash/fnv"
+)
+
+// defaultBloomBitsPerKey gives a false positive rate of about 1%.
+const defaultBloomBitsPerKey = 10
+
+// bloomFilter is a bloom filter over the keys of one SST file. The last byte
+// holds the number of probes, the rest is the bit array.
+type bloomFilter []byte
+
+// newBloomFilter builds a filter for keys using bitsPerKey bits per key.
+func newBloomFilter(keys []string, bitsPerKey int) bloomFilter {
+	// ln(2) * bitsPerKey probes minimises the false positive rate
+	probes := int(float64(bitsPerKey) * 0.69)
+	if probes < 1 {
+		probes = 1
+	}
+	if probes > 30 {
+		probes = 30
+	}
+
+	// Small filters have a high false positive rate, so enforce a minimum
+	bits := len(keys) * bitsPerKey
+	if bits < 64 {
+		bits = 64
+	}
+	bytes := (bits + 7) / 8
+	bits = bytes * 8
+
+	filter := make(bloomFilter, bytes+1)
+	filter[bytes] = byte(probes)
+	for _, key := range keys {
+		// Double hashing derives every probe from a single hash
+		h := bloomHash(key)
+		delta := h>>17 | h<<15
+		for i := 0; i < probes; i++ {
+			pos := h % uint32(bits)
+			filter[pos/8] |= 1 << (pos % 8)
+			h += delta
+		}
+	}
+	return filter
+}
+
+// mayContain reports whether key may be in the filter. A false result means
+// the key is definitely absent.
+func (f bloomFilter) mayContain(key string) bool {
+	if len(f) < 2 {
+		return true
+	}
+	bits := uint32(len(f)-1) * 8
+	probes := int(f[len(f)-1])
+
+	h := bloomHash(key)
+	delta := h>>17 | h<<15
+	for i := 0; i < probes; i++ {
+		pos := h % bits
+		if f[pos/8]&(1<<(pos%8)) == 0 {
+			return false
+		}
+		h += delta
+	}
+	return true
+}
+
+func bloomHash(key string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return h.Sum32()
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"container/heap"
+	"log"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// Flushes add level 0 files, whose key ranges may overlap. Compactions merge
+// files together as chosen by a compactionStrategy, see CompactionStyle, and
+// swap them for the merged output in a single MANIFEST edit.
+
+// compaction describes the files merged by one compaction.
+type compaction struct {
+	level       int
+	outputLevel int
+	inputs      []FileMeta // Files of level, newest first
+	lower       []FileMeta // Overlapping files of outputLevel, if below level
+}
+
+// scheduleCompaction wakes the compaction goroutine without waiting for it.
+func (mem *MemDB) scheduleCompaction() {
+	select {
+	case mem.compactCh <- struct{}{}:
+	default:
+	}
+}
+
+// backgroundCompaction runs compactions until the store is closed.
+func (mem *MemDB) backgroundCompaction() {
+	defer close(mem.compactionDone)
+	for {
+		select {
+		case <-mem.stopCompaction:
+			return
+		case <-mem.compactCh:
+			if err := mem.compact(); err != nil {
+				log.Println("Error compacting:", err)
+			}
+		}
+	}
+}
+
+// compact runs compactions until every level is within its size budget.
+func (mem *MemDB) compact() error {
+	mem.compactionMu.Lock()
+	defer mem.compactionMu.Unlock()
+
+	for {
+		select {
+		case <-mem.stopCompaction:
+			return nil
+		default:
+		}
+
+		c := mem.strategy.pick(mem.manifest.Files())
+		if c == nil {
+			return nil
+		}
+		if err := mem.runCompaction(c); err != nil {
+			return err
+		}
+		atomic.AddUint64(&mem.compactions, 1)
+	}
+}
+
+// keyRange returns the smallest and largest key of files.
+func keyRange(files []FileMeta) (string, string) {
+	smallest, largest := files[0].Smallest, files[0].Largest
+	for _, meta := range files[1:] {
+		if meta.Smallest < smallest {
+			smallest = meta.Smallest
+		}
+		if meta.Largest > largest {
+			largest = meta.Largest
+		}
+	}
+	return smallest, largest
+}
+
+// runCompaction merges the files of c into level c.outputLevel and swaps
+// them for the output in a single MANIFEST edit.
+func (mem *MemDB) runCompaction(c *compaction) error {
+	outputLevel := c.outputLevel
+
+	// A file that overlaps nothing below is moved without rewriting it
+	if c.level > 0 && c.level < outputLevel && len(c.inputs) == 1 && len(c.lower) == 0 {
+		moved := c.inputs[0]
+		moved.Level = outputLevel
+		return mem.manifest.Apply(VersionEdit{Added: []FileMeta{moved}, Deleted: []int{moved.Number}})
+	}
+
+	// Newer files come first, so the merge keeps their entries
+	inputs := append(append([]FileMeta(nil), c.inputs...), c.lower...)
+	merger, err := mem.newMergeIterator(inputs)
+	if err != nil {
+		return err
+	}
+
+	// Old versions are only needed for snapshots, and tombstones while an
+	// older file may hold the key. Those are the files after the inputs in
+	// lookup order. Expired values count as tombstones.
+	isInput := make(map[int]bool)
+	for _, meta := range inputs {
+		isInput[meta.Number] = true
+	}
+	var older []FileMeta
+	seenInput := false
+	for _, meta := range mem.manifest.Files() {
+		if isInput[meta.Number] {
+			seenInput = true
+		} else if seenInput {
+			older = append(older, meta)
+		}
+	}
+	smallestSeq, largestSeq := seqRange(inputs)
+	filter := newVersionFilter(mem.liveSnapshots())
+	now := time.Now().UnixNano()
+
+	var outputs []FileMeta
+	var out *compactionOutput
+	removeOutputs := func() {
+		if out != nil {
+			out.file.Close()
+			os.Remove(out.file.Name())
+		}
+		for _, meta := range outputs {
+			os.Remove(mem.names.sst(meta.Number))
+		}
+	}
+	for {
+		kv, ok, err := merger.Next()
+		if err != nil {
+			removeOutputs()
+			return err
+		}
+		if !ok {
+			break
+		}
+		kv = kv.tombstoneIfExpired(now)
+		if !filter.keep(kv) {
+			continue
+		}
+		if kv.Deleted && filter.visibleToAll(kv) && !mem.olderFilesContain(kv.Key, older) {
+			continue
+		}
+
+		// Start a new file at the target size, between two keys so that
+		// files of a level never share a key. A size-tiered run is merged
+		// into one file, or its outputs would form a run to merge again.
+		if out != nil && outputLevel > 0 && out.writer.size() >= uint64(mem.opts.TargetFileSize) && kv.Key != out.writer.largestKey {
+			meta, err := out.finish(outputLevel, smallestSeq, largestSeq)
+			if err != nil {
+				removeOutputs()
+				return err
+			}
+			outputs = append(outputs, meta)
+			out = nil
+		}
+		if out == nil {
+			if out, err = mem.newCompactionOutput(); err != nil {
+				removeOutputs()
+				return err
+			}
+		}
+		if err := out.writer.add(kv); err != nil {
+			removeOutputs()
+			return err
+		}
+	}
+	if out != nil {
+		meta, err := out.finish(outputLevel, smallestSeq, largestSeq)
+		if err != nil {
+			removeOutputs()
+			return err
+		}
+		outputs = append(outputs, meta)
+		out = nil
+	}
+
+	edit := VersionEdit{Added: outputs}
+	for _, meta := range inputs {
+		edit.Deleted = append(edit.Deleted, meta.Number)
+	}
+	if err := mem.manifest.Apply(edit); err != nil {
+		removeOutputs()
+		return err
+	}
+	for _, meta := range outputs {
+		atomic.AddUint64(&mem.bytesCompacted, uint64(meta.Size))
+	}
+
+	// Wait for running lookups before the inputs go away. Files read by
+	// open iterators stay until those are closed.
+	mem.mu.Lock()
+	defer mem.mu.Unlock()
+	for _, meta := range inputs {
+		if err := mem.deleteTable(meta.Number); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// seqRange returns the sequence numbers covered by files.
+func seqRange(files []FileMeta) (uint64, uint64) {
+	smallest, largest := files[0].SmallestSeq, files[0].LargestSeq
+	for _, meta := range files[1:] {
+		if meta.SmallestSeq < smallest {
+			smallest = meta.SmallestSeq
+		}
+		if meta.LargestSeq > largest {
+			largest = meta.LargestSeq
+		}
+	}
+	return smallest, largest
+}
+
+// compactionOutput is an SST file being written by a compaction.
+type compactionOutput struct {
+	number   int
+	filename string
+	file     *os.File
+	writer   *sstWriter
+}
+
+func (mem *MemDB) newCompactionOutput() (*compactionOutput, error) {
+	number := mem.manifest.NewFileNumber()
+	filename := mem.names.sst(number)
+	file, err := createSSTFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	writer, err := newSSTWriter(file, mem.bloomBitsPerKey())
+	if err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, err
+	}
+	return &compactionOutput{number: number, filename: filename, file: file, writer: writer}, nil
+}
+
+// finish completes the file and commits it to disk, since the inputs are
+// deleted once the output is live.
+func (out *compactionOutput) finish(level int, smallestSeq, largestSeq uint64) (FileMeta, error) {
+	if err := out.writer.finish(); err != nil {
+		return FileMeta{}, err
+	}
+	if err := commitSSTFile(out.file, out.filename); err != nil {
+		return FileMeta{}, err
+	}
+	return FileMeta{
+		Number:      out.number,
+		Level:       level,
+		Smallest:    out.writer.smallestKey,
+		Largest:     out.writer.largestKey,
+		SmallestSeq: smallestSeq,
+		LargestSeq:  largestSeq,
+		Size:        int64(out.writer.size()),
+	}, nil
+}
+
+// mergeIterator merges SST files into a single stream in the order of
+// lessKeyValue, every version included. Entries with the same sequence
+// number, which only files written before sequence numbers have, come
+// newest file first.
+type mergeIterator struct {
+	sources mergeHeap
+}
+
+type mergeSource struct {
+	it   *tableIterator
+	kv   KeyValue
+	rank int // Position of the file, lower is newer
+}
+
+// newMergeIterator merges files, which must be given newest first.
+func (mem *MemDB) newMergeIterator(files []FileMeta) (*mergeIterator, error) {
+	m := &mergeIterator{}
+	for rank, meta := range files {
+		table, err := mem.table(mem.names.sst(meta.Number))
+		if err != nil {
+			return nil, err
+		}
+		src := &mergeSource{it: table.iterator(), rank: rank}
+		kv, ok, err := src.it.Next()
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			src.kv = kv
+			m.sources = append(m.sources, src)
+		}
+	}
+	heap.Init(&m.sources)
+	return m, nil
+}
+
+// Next returns the next entry, or false once every file is exhausted.
+func (m *mergeIterator) Next() (KeyValue, bool, error) {
+	if len(m.sources) == 0 {
+		return KeyValue{}, false, nil
+	}
+	src := m.sources[0]
+	kv := src.kv
+
+	next, ok, err := src.it.Next()
+	if err != nil {
+		return KeyValue{}, false, err
+	}
+	if ok {
+		src.kv = next
+		heap.Fix(&m.sources, 0)
+	} else {
+		heap.Pop(&m.sources)
+	}
+	return kv, true, nil
+}
+
+// mergeHeap orders merge sources by lessKeyValue, then newest file first.
+type mergeHeap []*mergeSource
+
+func (h mergeHeap) Len() int { return len(h) }
+
+func (h mergeHeap) Less(i, j int) bool {
+	if h[i].kv.Key != h[j].kv.Key || h[i].kv.Seq != h[j].kv.Seq {
+		return lessKeyValue(h[i].kv, h[j].kv)
+	}
+	return h[i].rank < h[j].rank
+}
+
+func (h mergeHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *mergeHeap) Push(x interface{}) { *h = append(*h, x.(*mergeSource)) }
+
+func (h *mergeHeap) Pop() interface{} {
+	old := *h
+	src := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return src
+}
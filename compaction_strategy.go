@@ -0,0 +1,172 @@
+package main
+
+import (
+	"sort"
+)
+
+// CompactionStyle selects how SST files are compacted.
+type CompactionStyle int
+
+const (
+	// LeveledCompaction keeps every level from 1 on as a sorted run of
+	// non-overlapping files and pushes data down when a level outgrows its
+	// budget. Reads check few files, at the cost of rewriting data often.
+	LeveledCompaction CompactionStyle = iota
+	// SizeTieredCompaction keeps every file in level 0 and merges runs of
+	// files of similar size. Data is rewritten less often, but reads may
+	// have to check more files.
+	SizeTieredCompaction
+)
+
+func (style CompactionStyle) String() string {
+	switch style {
+	case LeveledCompaction:
+		return "leveled"
+	case SizeTieredCompaction:
+		return "size-tiered"
+	}
+	return "unknown"
+}
+
+// compactionStrategy decides which files are compacted together. It is only
+// called by one compaction at a time.
+type compactionStrategy interface {
+	// pick returns the next compaction for the live files, given in lookup
+	// order, or nil if none is needed.
+	pick(files []FileMeta) *compaction
+}
+
+func newCompactionStrategy(opts Options) compactionStrategy {
+	if opts.CompactionStyle == SizeTieredCompaction {
+		return &sizeTieredStrategy{opts: opts}
+	}
+	return &leveledStrategy{opts: opts, compactPointer: make(map[int]string)}
+}
+
+// leveledStrategy implements LeveledCompaction.
+type leveledStrategy struct {
+	opts           Options
+	compactPointer map[int]string // Largest key last compacted per level
+}
+
+// maxBytesForLevel returns the size budget of a level from 1 on.
+func (s *leveledStrategy) maxBytesForLevel(level int) float64 {
+	size := float64(s.opts.LevelSizeBase)
+	for ; level > 1; level-- {
+		size *= float64(s.opts.LevelSizeMultiplier)
+	}
+	return size
+}
+
+// pick returns the compaction of the level furthest over its budget. Level 0
+// is scored by file count, since every file there may have to be checked on
+// a lookup.
+func (s *leveledStrategy) pick(files []FileMeta) *compaction {
+	levels := make([][]FileMeta, s.opts.NumLevels)
+	sizes := make([]int64, s.opts.NumLevels)
+	for _, meta := range files {
+		levels[meta.Level] = append(levels[meta.Level], meta)
+		sizes[meta.Level] += meta.Size
+	}
+
+	bestLevel, bestScore := -1, 1.0
+	for level := 0; level < s.opts.NumLevels-1; level++ {
+		var score float64
+		if level == 0 {
+			score = float64(len(levels[0])) / float64(s.opts.L0CompactionTrigger)
+		} else {
+			score = float64(sizes[level]) / s.maxBytesForLevel(level)
+		}
+		if score >= bestScore {
+			bestLevel, bestScore = level, score
+		}
+	}
+	if bestLevel < 0 {
+		return nil
+	}
+
+	c := &compaction{level: bestLevel, outputLevel: bestLevel + 1}
+	if bestLevel == 0 {
+		// Level 0 files overlap, so they all go down together
+		c.inputs = levels[0]
+	} else {
+		// Take turns through the key space of the level, starting over
+		// after its last file
+		candidates := append([]FileMeta(nil), levels[bestLevel]...)
+		sort.Slice(candidates, func(i, j int) bool {
+			return candidates[i].Smallest < candidates[j].Smallest
+		})
+		c.inputs = []FileMeta{candidates[0]}
+		for _, meta := range candidates {
+			if meta.Smallest > s.compactPointer[bestLevel] {
+				c.inputs[0] = meta
+				break
+			}
+		}
+		s.compactPointer[bestLevel] = c.inputs[0].Largest
+	}
+
+	smallest, largest := keyRange(c.inputs)
+	for _, meta := range levels[bestLevel+1] {
+		if meta.Largest >= smallest && meta.Smallest <= largest {
+			c.lower = append(c.lower, meta)
+		}
+	}
+	return c
+}
+
+// Files whose size is within these bounds of the average size of a run are
+// merged together by sizeTieredStrategy.
+const (
+	sizeTieredBucketLow  = 0.5
+	sizeTieredBucketHigh = 1.5
+)
+
+// sizeTieredStrategy implements SizeTieredCompaction.
+type sizeTieredStrategy struct {
+	opts Options
+}
+
+// pick returns the run of similarly sized files with the smallest average
+// size, if it has at least SizeTieredMinFiles files. Runs are contiguous in
+// lookup order, so the output takes the place of its inputs.
+func (s *sizeTieredStrategy) pick(files []FileMeta) *compaction {
+	var best []FileMeta
+	var bestAverage float64
+	consider := func(run []FileMeta, total int64) {
+		if len(run) < s.opts.SizeTieredMinFiles {
+			return
+		}
+		average := float64(total) / float64(len(run))
+		if best == nil || average < bestAverage {
+			best, bestAverage = run, average
+		}
+	}
+
+	// Files left in deeper levels by leveled compaction stay where they are
+	var run []FileMeta
+	var total int64
+	for _, meta := range files {
+		if meta.Level > 0 {
+			break
+		}
+		if len(run) > 0 && (len(run) >= s.opts.SizeTieredMaxFiles || !similarSize(meta.Size, total, len(run))) {
+			consider(run, total)
+			run, total = nil, 0
+		}
+		run = append(run, meta)
+		total += meta.Size
+	}
+	consider(run, total)
+
+	if best == nil {
+		return nil
+	}
+	return &compaction{level: 0, outputLevel: 0, inputs: best}
+}
+
+// similarSize reports whether size fits in a run of count files of total size.
+func similarSize(size, total int64, count int) bool {
+	average := float64(total) / float64(count)
+	return float64(size) >= average*sizeTieredBucketLow && float64(size) <= average*sizeTieredBucketHigh
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// openCompactionTestDB opens a store whose levels fill up after a few flushes.
+func openCompactionTestDB(t *testing.T, dir string) *MemDB {
+	t.Helper()
+	opts := testOptions()
+	opts.L0CompactionTrigger = 2
+	opts.LevelSizeBase = 512
+	opts.LevelSizeMultiplier = 2
+	opts.TargetFileSize = 256
+	memDB, err := Open(dir, opts)
+	if err != nil {
+		t.Fatalf("Error opening MemDB: %v", err)
+	}
+	return memDB
+}
+
+func TestCompactionKeepsNewestValues(t *testing.T) {
+	dir := t.TempDir()
+	memDB := openCompactionTestDB(t, dir)
+
+	expected := make(map[string]string)
+	for round := 0; round < 10; round++ {
+		for i := 0; i < 20; i++ {
+			key := "key" + strconv.Itoa((i*7+round)%30)
+			value := "value" + strconv.Itoa(round) + "-" + strconv.Itoa(i)
+			if err := memDB.Set(key, value); err != nil {
+				t.Fatalf("Error setting key-value pair: %v", err)
+			}
+			expected[key] = value
+		}
+		key := "key" + strconv.Itoa(round*3)
+		if _, ok := expected[key]; ok {
+			if _, err := memDB.Del(key); err != nil {
+				t.Fatalf("Error deleting key-value pair: %v", err)
+			}
+			delete(expected, key)
+		}
+	}
+	if err := memDB.waitForFlushes(); err != nil {
+		t.Fatalf("Error flushing memtable: %v", err)
+	}
+	if err := memDB.compact(); err != nil {
+		t.Fatalf("Error compacting: %v", err)
+	}
+
+	stats := memDB.Stats()
+	if stats.Compactions == 0 {
+		t.Fatal("Expected compactions to run")
+	}
+	if stats.LevelFiles[0] >= 2 {
+		t.Errorf("Expected level 0 to be compacted, got %v files per level", stats.LevelFiles)
+	}
+
+	// Levels from 1 on must not overlap, and each key is kept once per level
+	files := memDB.manifest.Files()
+	for i, a := range files {
+		for _, b := range files[i+1:] {
+			if a.Level > 0 && a.Level == b.Level && a.Largest >= b.Smallest && b.Largest >= a.Smallest {
+				t.Errorf("Expected files %d and %d of level %d not to overlap", a.Number, b.Number, a.Level)
+			}
+		}
+	}
+
+	// Compacted inputs are deleted
+	matches, err := filepath.Glob(memDB.names.sstGlob())
+	if err != nil {
+		t.Fatalf("Error listing SST files: %v", err)
+	}
+	if len(matches) != len(files) {
+		t.Errorf("Expected %d SST files on disk, got %d", len(files), len(matches))
+	}
+	memDB.Close()
+
+	memDB = openCompactionTestDB(t, dir)
+	defer memDB.Close()
+	for i := 0; i < 30; i++ {
+		key := "key" + strconv.Itoa(i)
+		result, err := memDB.Get(key)
+		if value, ok := expected[key]; ok {
+			if err != nil || result != value {
+				t.Errorf("Expected %s for %s, got %q (%v)", value, key, result, err)
+			}
+		} else if err == nil {
+			t.Errorf("Expected error for Get of deleted %s, got %q", key, result)
+		}
+	}
+}
+
+func TestOpenRejectsFewerLevelsThanStored(t *testing.T) {
+	opts := testOptions()
+	opts.Dir = t.TempDir()
+	manifest, err := OpenManifest(opts.fileNames())
+	if err != nil {
+		t.Fatalf("Error opening MANIFEST: %v", err)
+	}
+	if err := manifest.Apply(VersionEdit{Added: []FileMeta{{Number: 1, Level: 4, Smallest: "a", Largest: "z"}}}); err != nil {
+		t.Fatalf("Error applying version edit: %v", err)
+	}
+	manifest.Close()
+
+	opts.NumLevels = 3
+	if memDB, err := Open(opts.Dir, opts); err == nil {
+		memDB.Close()
+		t.Fatal("Expected error opening a store with files below the last level, but got nil")
+	}
+}
+
+func TestCompactionDropsObsoleteTombstones(t *testing.T) {
+	memDB := openCompactionTestDB(t, t.TempDir())
+	defer memDB.Close()
+
+	// Flush the key, then its tombstone, into level 0
+	for i := 0; i <= threshold; i++ {
+		if err := memDB.Set("key"+strconv.Itoa(i), "value"); err != nil {
+			t.Fatalf("Error setting key-value pair: %v", err)
+		}
+	}
+	if _, err := memDB.Del("key0"); err != nil {
+		t.Fatalf("Error deleting key-value pair: %v", err)
+	}
+	for i := 0; i < threshold; i++ {
+		if err := memDB.Set("other"+strconv.Itoa(i), "value"); err != nil {
+			t.Fatalf("Error setting key-value pair: %v", err)
+		}
+	}
+	if err := memDB.waitForFlushes(); err != nil {
+		t.Fatalf("Error flushing memtable: %v", err)
+	}
+	if err := memDB.compact(); err != nil {
+		t.Fatalf("Error compacting: %v", err)
+	}
+
+	// Nothing is left below the output, so neither entry of key0 survives
+	for _, meta := range memDB.manifest.Files() {
+		if meta.Level == 0 {
+			t.Fatalf("Expected level 0 to be empty, got %+v", meta)
+		}
+		keyValues, _, _, err := parseSSTFile(memDB.names.sst(meta.Number))
+		if err != nil {
+			t.Fatalf("Error parsing SST file: %v", err)
+		}
+		for _, kv := range keyValues {
+			if kv.Key == "key0" {
+				t.Errorf("Expected key0 to be dropped, got %+v", kv)
+			}
+		}
+	}
+	if _, err := memDB.Get("key0"); err == nil {
+		t.Error("Expected error for Get after deletion and compaction, but got nil")
+	}
+}
+
+func TestSizeTieredPicksSimilarlySizedRun(t *testing.T) {
+	opts := DefaultOptions()
+	opts.CompactionStyle = SizeTieredCompaction
+	strategy := newCompactionStrategy(opts.withDefaults())
+
+	// Newest first: a run of four small files, a large one, then three
+	// small files that are too few to merge
+	var files []FileMeta
+	for i, size := range []int64{100, 120, 90, 110, 5000, 100, 100, 100} {
+		files = append(files, FileMeta{Number: 8 - i, Size: size, SmallestSeq: uint64(8 - i), LargestSeq: uint64(8 - i)})
+	}
+
+	c := strategy.pick(files)
+	if c == nil {
+		t.Fatal("Expected a size-tiered compaction")
+	}
+	if c.outputLevel != 0 || len(c.inputs) != 4 || c.inputs[0].Number != 8 || c.inputs[3].Number != 5 {
+		t.Errorf("Expected files 8 to 5 to be merged into level 0, got %+v", c)
+	}
+	if c := strategy.pick(files[4:]); c != nil {
+		t.Errorf("Expected no compaction without enough similar files, got %+v", c)
+	}
+}
+
+func TestCompactionStylesReportWriteAmplification(t *testing.T) {
+	for _, style := range []CompactionStyle{LeveledCompaction, SizeTieredCompaction} {
+		opts := testOptions()
+		opts.CompactionStyle = style
+		opts.L0CompactionTrigger = 2
+		opts.LevelSizeBase = 512
+		opts.LevelSizeMultiplier = 2
+		opts.SizeTieredMinFiles = 2
+		memDB, err := Open(t.TempDir(), opts)
+		if err != nil {
+			t.Fatalf("Error opening MemDB: %v", err)
+		}
+
+		for i := 0; i < 200; i++ {
+			if err := memDB.Set("key"+strconv.Itoa(i%50), "value"+strconv.Itoa(i)); err != nil {
+				t.Fatalf("Error setting key-value pair: %v", err)
+			}
+		}
+		if err := memDB.waitForFlushes(); err != nil {
+			t.Fatalf("Error flushing memtable: %v", err)
+		}
+		if err := memDB.compact(); err != nil {
+			t.Fatalf("Error compacting: %v", err)
+		}
+
+		stats := memDB.Stats()
+		if stats.CompactionStyle != style || stats.Compactions == 0 || stats.BytesFlushed == 0 {
+			t.Errorf("Expected %s compactions to be reported, got %+v", style, stats)
+		}
+		if style == SizeTieredCompaction && stats.LevelFiles[0] != len(memDB.manifest.Files()) {
+			t.Errorf("Expected size-tiered compaction to keep every file in level 0, got %v", stats.LevelFiles)
+		}
+		if stats.WriteAmplification < 1 {
+			t.Errorf("Expected write amplification of at least 1, got %f", stats.WriteAmplification)
+		}
+
+		for i := 150; i < 200; i++ {
+			key := "key" + strconv.Itoa(i%50)
+			if result, err := memDB.Get(key); err != nil || result != "value"+strconv.Itoa(i) {
+				t.Errorf("Expected value%d for %s with %s compaction, got %q (%v)", i, key, style, result, err)
+			}
+		}
+		memDB.Close()
+	}
+}
+
+func TestSizeTieredCompactionSettles(t *testing.T) {
+	opts := testOptions()
+	opts.CompactionStyle = SizeTieredCompaction
+	opts.MemtableSize = 64 << 10
+	opts.TargetFileSize = 32 << 10
+	memDB, err := Open(t.TempDir(), opts)
+	if err != nil {
+		t.Fatalf("Error opening MemDB: %v", err)
+	}
+	defer memDB.Close()
+
+	value := strings.Repeat("v", 100)
+	for i := 0; i < 3000; i++ {
+		if err := memDB.Set("key"+strconv.Itoa(i), value); err != nil {
+			t.Fatalf("Error setting key-value pair: %v", err)
+		}
+	}
+	if err := memDB.Flush(); err != nil {
+		t.Fatalf("Error flushing memtable: %v", err)
+	}
+
+	// Once idle, the background compaction runs out of runs to merge
+	deadline := time.Now().Add(5 * time.Second)
+	compactions := memDB.Stats().Compactions
+	for {
+		time.Sleep(200 * time.Millisecond)
+		stats := memDB.Stats()
+		if stats.Compactions == compactions {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected compactions to stop while idle, got %d and counting", stats.Compactions)
+		}
+		compactions = stats.Compactions
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"sync/atomic"
+	"time"
+)
+
+// Condition decides whether a conditional write goes ahead, given the
+// current value of its key and the sequence number of that value, its
+// version. exists is false if the key is missing, deleted or expired.
+type Condition func(value string, version uint64, exists bool) bool
+
+// errConditionFailed is returned by the check of a conditional write whose
+// condition does not hold.
+var errConditionFailed = errors.New("Condition failed")
+
+// GetVersion gets the value of key and its version, the sequence number of
+// the write that stored it. The version changes with every write of the key.
+func (mem *MemDB) GetVersion(key string) (string, uint64, error) {
+	entry, err := mem.GetEntry(key)
+	return entry.Value, entry.Seq, err
+}
+
+// GetEntry gets the value of key together with its version and its expiry
+// time, see KeyValue.
+func (mem *MemDB) GetEntry(key string) (ValueMarkerPair, error) {
+	return mem.getEntry(key, atomic.LoadUint64(&mem.visibleSeq))
+}
+
+// SetIf sets the value of key if cond holds for its current value. It
+// returns false, and writes nothing, if it does not. No other write can
+// come in between the check and the set.
+func (mem *MemDB) SetIf(key, value string, cond Condition) (bool, error) {
+	batch := NewWriteBatch()
+	batch.Set(key, value)
+	_, ok, err := mem.WriteIf(key, batch, cond)
+	return ok, err
+}
+
+// DelIf deletes key if cond holds for its current value, like SetIf.
+func (mem *MemDB) DelIf(key string, cond Condition) (bool, error) {
+	batch := NewWriteBatch()
+	batch.Del(key)
+	_, ok, err := mem.WriteIf(key, batch, cond)
+	return ok, err
+}
+
+// CompareAndSwap sets key to value if its current value is expected.
+func (mem *MemDB) CompareAndSwap(key, expected, value string) (bool, error) {
+	return mem.SetIf(key, value, func(current string, _ uint64, exists bool) bool {
+		return exists && current == expected
+	})
+}
+
+// SetIfAbsent sets key to value if the key is missing or deleted.
+func (mem *MemDB) SetIfAbsent(key, value string) (bool, error) {
+	return mem.SetIf(key, value, func(_ string, _ uint64, exists bool) bool {
+		return !exists
+	})
+}
+
+// DeleteIfEquals deletes key if its current value is expected.
+func (mem *MemDB) DeleteIfEquals(key, expected string) (bool, error) {
+	return mem.DelIf(key, func(current string, _ uint64, exists bool) bool {
+		return exists && current == expected
+	})
+}
+
+// WriteIf writes batch if cond holds for the current value of key, like
+// SetIf. It also returns the new version of key: the sequence number of the
+// last operation of batch on key, or 0 if batch does not write key.
+func (mem *MemDB) WriteIf(key string, batch *WriteBatch, cond Condition) (uint64, bool, error) {
+	seq, err := mem.writeIf(batch, func() error {
+		mem.mu.RLock()
+		current, found, err := mem.lookup(key, math.MaxUint64)
+		mem.mu.RUnlock()
+		if err != nil {
+			return err
+		}
+		exists := found && current.Marker && !current.expired(time.Now().UnixNano())
+		if !exists {
+			current = ValueMarkerPair{}
+		}
+		if !cond(current.Value, current.Seq, exists) {
+			return errConditionFailed
+		}
+		return nil
+	})
+	if err == errConditionFailed {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+
+	// The operations of batch took the sequence numbers up to seq in order
+	for i := batch.Len() - 1; i >= 0; i-- {
+		if batch.records[i].Key == key {
+			return seq - uint64(batch.Len()-1-i), true, nil
+		}
+	}
+	return 0, true, nil
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestConditionalWrites(t *testing.T) {
+	memDB := openTestDB(t, t.TempDir())
+	defer memDB.Close()
+
+	check := func(name string, ok bool, err error, want bool) {
+		t.Helper()
+		if err != nil || ok != want {
+			t.Errorf("Expected %s to return %v, got %v (%v)", name, want, ok, err)
+		}
+	}
+
+	ok, err := memDB.SetIfAbsent("key", "first")
+	check("SetIfAbsent of a missing key", ok, err, true)
+	ok, err = memDB.SetIfAbsent("key", "second")
+	check("SetIfAbsent of an existing key", ok, err, false)
+	ok, err = memDB.CompareAndSwap("key", "second", "third")
+	check("CompareAndSwap with a stale value", ok, err, false)
+	ok, err = memDB.CompareAndSwap("key", "first", "third")
+	check("CompareAndSwap with the current value", ok, err, true)
+	ok, err = memDB.CompareAndSwap("missing", "", "value")
+	check("CompareAndSwap of a missing key", ok, err, false)
+
+	if value, err := memDB.Get("key"); err != nil || value != "third" {
+		t.Errorf("Expected third for key, got %q (%v)", value, err)
+	}
+
+	ok, err = memDB.DeleteIfEquals("key", "first")
+	check("DeleteIfEquals with a stale value", ok, err, false)
+	ok, err = memDB.DeleteIfEquals("key", "third")
+	check("DeleteIfEquals with the current value", ok, err, true)
+	if _, err := memDB.Get("key"); err == nil {
+		t.Error("Expected key to be deleted")
+	}
+	ok, err = memDB.SetIfAbsent("key", "again")
+	check("SetIfAbsent of a deleted key", ok, err, true)
+
+	// The version changes with every write, flushed or not
+	_, version, err := memDB.GetVersion("key")
+	if err != nil {
+		t.Fatalf("Error getting version: %v", err)
+	}
+	if err := memDB.Flush(); err != nil {
+		t.Fatalf("Error flushing memtable: %v", err)
+	}
+	if _, flushed, err := memDB.GetVersion("key"); err != nil || flushed != version {
+		t.Errorf("Expected version %d after a flush, got %d (%v)", version, flushed, err)
+	}
+	ok, err = memDB.SetIf("key", "versioned", func(_ string, current uint64, exists bool) bool {
+		return exists && current == version
+	})
+	check("SetIf with the current version", ok, err, true)
+	if _, newer, _ := memDB.GetVersion("key"); newer <= version {
+		t.Errorf("Expected a version after %d, got %d", version, newer)
+	}
+}
+
+func TestWriteIfReturnsVersion(t *testing.T) {
+	memDB := openTestDB(t, t.TempDir())
+	defer memDB.Close()
+
+	// The version is that of the last write of the key in the batch
+	batch := NewWriteBatch()
+	batch.Set("key", "first")
+	batch.Set("key", "second")
+	batch.Set("other", "value")
+	always := func(string, uint64, bool) bool { return true }
+	version, ok, err := memDB.WriteIf("key", batch, always)
+	if err != nil || !ok {
+		t.Fatalf("Error writing batch: %v", err)
+	}
+	if entry, err := memDB.GetEntry("key"); err != nil || entry.Seq != version || entry.Value != "second" {
+		t.Errorf("Expected version %d of key to hold second, got %+v (%v)", version, entry, err)
+	}
+
+	never := func(string, uint64, bool) bool { return false }
+	if version, ok, err := memDB.WriteIf("key", batch, never); err != nil || ok || version != 0 {
+		t.Errorf("Expected a failed condition to write nothing, got version %d, %v (%v)", version, ok, err)
+	}
+}
+
+func TestCompareAndSwapWithoutLostUpdates(t *testing.T) {
+	memDB := openTestDB(t, t.TempDir())
+	defer memDB.Close()
+
+	memDB.Set("counter", "0")
+
+	// Every increment retries until its swap succeeds
+	const workers, increments = 4, 20
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < increments; {
+				value, err := memDB.Get("counter")
+				if err != nil {
+					t.Errorf("Error reading counter: %v", err)
+					return
+				}
+				n, _ := strconv.Atoi(value)
+				ok, err := memDB.CompareAndSwap("counter", value, strconv.Itoa(n+1))
+				if err != nil {
+					t.Errorf("Error swapping counter: %v", err)
+					return
+				}
+				if ok {
+					i++
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if value, err := memDB.Get("counter"); err != nil || value != strconv.Itoa(workers*increments) {
+		t.Errorf("Expected the counter at %d, got %q (%v)", workers*increments, value, err)
+	}
+}
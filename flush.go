@@ -0,0 +1,194 @@
+package main
+
+import (
+	"log"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// Backoff between the attempts of a failing flush.
+const (
+	flushRetryMin = 100 * time.Millisecond
+	flushRetryMax = 10 * time.Second
+)
+
+// A full memtable is rotated out as an immutable memtable, which stays
+// readable until a background goroutine has flushed it to a level 0 SST
+// file. Its WAL segments are released once the file is live.
+
+// immutableMemtable is a memtable waiting to be flushed.
+type immutableMemtable struct {
+	memtable    Memtable
+	logNumber   int    // First WAL segment written after the rotation
+	smallestSeq uint64 // Sequence numbers of the records it holds
+	largestSeq  uint64
+}
+
+// rotateMemtable moves the memtable to the immutable memtables and starts a
+// new one with a new WAL segment. Writers stall here while
+// MaxImmutableMemtables are already waiting for a flush, and get the flush
+// error if one of those fails. writeMu must be held, so no record is
+// written between the WAL and the memtable switch.
+func (mem *MemDB) rotateMemtable() error {
+	mem.mu.Lock()
+	for len(mem.immutables) >= mem.opts.MaxImmutableMemtables {
+		if err := mem.flushErr; err != nil {
+			mem.mu.Unlock()
+			return err
+		}
+		mem.flushed.Wait()
+	}
+	mem.mu.Unlock()
+
+	// Readers are not held up by the fsync of the segment switch
+	segment, lastSeq, err := mem.wal.Rotate()
+	if err != nil {
+		return err
+	}
+
+	mem.mu.Lock()
+	defer mem.mu.Unlock()
+	mem.immutables = append(mem.immutables, &immutableMemtable{
+		memtable:    mem.memtable,
+		logNumber:   segment,
+		smallestSeq: mem.rotatedSeq + 1,
+		largestSeq:  lastSeq,
+	})
+	mem.rotatedSeq = lastSeq
+	mem.memtable = newMemtable(mem.opts.MemtableType)
+
+	select {
+	case mem.flushCh <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// backgroundFlush flushes the immutable memtables until the store is closed.
+// A failed flush is retried after flushRetryMin, and after twice as long
+// each time it fails again, up to flushRetryMax.
+func (mem *MemDB) backgroundFlush() {
+	defer close(mem.flushDone)
+	var retry <-chan time.Time
+	backoff := flushRetryMin
+	for {
+		select {
+		case <-mem.stopFlush:
+			return
+		case <-mem.flushCh:
+		case <-retry:
+		}
+		if err := mem.flushImmutables(); err != nil {
+			log.Println("Error flushing memtable:", err)
+			retry = time.After(backoff)
+			backoff = min(2*backoff, flushRetryMax)
+		} else {
+			retry = nil
+			backoff = flushRetryMin
+		}
+	}
+}
+
+// flushImmutables flushes the immutable memtables, oldest first, so an
+// older memtable is always in an SST file by the time a newer one is
+// flushed. A failed flush is kept in flushErr until the next attempt.
+func (mem *MemDB) flushImmutables() error {
+	for {
+		mem.mu.Lock()
+		if len(mem.immutables) == 0 {
+			mem.mu.Unlock()
+			return nil
+		}
+		imm := mem.immutables[0]
+		mem.flushErr = nil
+		mem.mu.Unlock()
+
+		err := mem.flushImmutable(imm)
+
+		mem.mu.Lock()
+		if err != nil {
+			mem.flushErr = err
+		} else {
+			mem.immutables = mem.immutables[1:]
+		}
+		mem.flushed.Broadcast()
+		mem.mu.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// flushImmutable writes imm to a level 0 SST file and makes it live, then
+// releases the WAL segments holding its records.
+func (mem *MemDB) flushImmutable(imm *immutableMemtable) error {
+	// Old versions only need to be kept for snapshots, and tombstones while
+	// an older file holds the key
+	keyValues := mem.dropObsoleteVersions(imm.memtable.GetKeyValues())
+
+	edit := VersionEdit{LogNumber: imm.logNumber, LastSeq: imm.largestSeq}
+	var size int64
+	if len(keyValues) > 0 {
+		number := mem.manifest.NewFileNumber()
+		filename := mem.names.sst(number)
+		if err := flushSSTFile(filename, keyValues, mem.bloomBitsPerKey()); err != nil {
+			return err
+		}
+		info, err := os.Stat(filename)
+		if err != nil {
+			return err
+		}
+		size = info.Size()
+
+		edit.Added = []FileMeta{{
+			Number:      number,
+			Level:       0,
+			Smallest:    keyValues[0].Key,
+			Largest:     keyValues[len(keyValues)-1].Key,
+			SmallestSeq: imm.smallestSeq,
+			LargestSeq:  imm.largestSeq,
+			Size:        size,
+		}}
+		edit.NextFileNumber = number + 1
+	}
+
+	// Make the file live before the WAL records it holds are dropped
+	if err := mem.manifest.Apply(edit); err != nil {
+		return err
+	}
+	atomic.AddUint64(&mem.bytesFlushed, uint64(size))
+	if err := mem.wal.Release(imm.logNumber); err != nil {
+		return err
+	}
+
+	// Let the compaction strategy look at the new file
+	mem.scheduleCompaction()
+	return nil
+}
+
+// Flush rotates the memtable, if it holds anything, and waits until every
+// immutable memtable is stored in an SST file.
+func (mem *MemDB) Flush() error {
+	mem.writeMu.Lock()
+	var err error
+	if mem.memtable.Len() > 0 {
+		err = mem.rotateMemtable()
+	}
+	mem.writeMu.Unlock()
+	if err != nil {
+		return err
+	}
+	return mem.waitForFlushes()
+}
+
+// waitForFlushes waits until no immutable memtable is left, or a flush fails.
+func (mem *MemDB) waitForFlushes() error {
+	mem.mu.Lock()
+	defer mem.mu.Unlock()
+
+	for len(mem.immutables) > 0 && mem.flushErr == nil {
+		mem.flushed.Wait()
+	}
+	return mem.flushErr
+}
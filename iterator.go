@@ -0,0 +1,476 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// IteratorOptions bounds the keys returned by an Iterator. LowerBound is
+// inclusive and UpperBound exclusive, and an empty bound leaves that side
+// open.
+type IteratorOptions struct {
+	LowerBound string
+	UpperBound string
+}
+
+// Iterator walks the live keys of the store in key order, in either
+// direction. It merges the memtables and every SST level: the newest version
+// of a key wins, and deleted keys are skipped, as are values that have
+// expired by the time the iterator was created. The memtables are read in
+// place, so a value the TTL sweeper removes while the iterator is open may be
+// skipped even if it expired later.
+//
+// An Iterator sees the store as of the last write applied when it was
+// created, or as of its Snapshot. The SST files it reads are kept on disk
+// until it is closed, even if a compaction replaces them. An Iterator is not
+// safe for concurrent use, and must be closed before the store.
+type Iterator struct {
+	mem      *MemDB
+	opts     IteratorOptions
+	children []internalIterator // Newest first, so the first of equal keys wins
+	pinned   []int              // SST files kept for the iterator
+	forward  bool
+	now      int64 // Values that expire by then are skipped like deleted keys
+	current  KeyValue
+	valid    bool
+	err      error
+	closed   bool
+}
+
+// internalIterator walks the entries of one memtable or SST file in the
+// order of lessKeyValue, tombstones and every version included.
+type internalIterator interface {
+	seek(key string)       // Positions at the newest version of the first key at or after key
+	seekBefore(key string) // Positions at the oldest version of the last key before key
+	seekToFirst()
+	seekToLast()
+	next()
+	prev()
+	valid() bool
+	entry() KeyValue
+	error() error
+}
+
+// NewIterator returns an unpositioned iterator over the store. Call Seek,
+// SeekToFirst or SeekToLast before reading from it.
+func (mem *MemDB) NewIterator(opts IteratorOptions) *Iterator {
+	return mem.newIterator(opts, atomic.LoadUint64(&mem.visibleSeq))
+}
+
+// newIterator returns an iterator over the versions numbered at most seq.
+func (mem *MemDB) newIterator(opts IteratorOptions, seq uint64) *Iterator {
+	it := &Iterator{mem: mem, opts: opts, now: time.Now().UnixNano()}
+
+	// Holding mu keeps the files from being deleted before they are pinned
+	mem.mu.RLock()
+	defer mem.mu.RUnlock()
+
+	memtables := []Memtable{mem.memtable}
+	for i := len(mem.immutables) - 1; i >= 0; i-- {
+		memtables = append(memtables, mem.immutables[i].memtable)
+	}
+	for _, memtable := range memtables {
+		it.children = append(it.children, &versionIterator{raw: memtable.NewIterator(), seq: seq})
+	}
+
+	var files []FileMeta
+	for _, meta := range mem.manifest.Files() {
+		if opts.overlaps(meta.Smallest, meta.Largest) {
+			files = append(files, meta)
+		}
+	}
+	// Close unpins every file, even those after one that fails to open
+	mem.pinTables(files)
+	for _, meta := range files {
+		it.pinned = append(it.pinned, meta.Number)
+	}
+	for _, meta := range files {
+		table, err := mem.table(mem.names.sst(meta.Number))
+		if err != nil {
+			it.err = err
+			break
+		}
+		it.children = append(it.children, &versionIterator{raw: &sstIterator{table: table}, seq: seq})
+	}
+	return it
+}
+
+// overlaps reports whether any key from smallest to largest is in bounds.
+func (opts IteratorOptions) overlaps(smallest, largest string) bool {
+	return largest >= opts.LowerBound && (opts.UpperBound == "" || smallest < opts.UpperBound)
+}
+
+// Valid reports whether the iterator is positioned at a key.
+func (it *Iterator) Valid() bool {
+	return it.valid && it.err == nil
+}
+
+// Key returns the current key. The iterator must be valid.
+func (it *Iterator) Key() string {
+	return it.current.Key
+}
+
+// Value returns the value of the current key. The iterator must be valid.
+func (it *Iterator) Value() string {
+	return it.current.Value
+}
+
+// Error returns the first error met by the iterator, such as a corrupt SST
+// file. The iterator is no longer valid once it has failed.
+func (it *Iterator) Error() error {
+	return it.err
+}
+
+// Seek positions the iterator at the first key at or after key.
+func (it *Iterator) Seek(key string) {
+	if key < it.opts.LowerBound {
+		key = it.opts.LowerBound
+	}
+	for _, child := range it.children {
+		child.seek(key)
+	}
+	it.forward = true
+	it.findSmallest()
+	it.skipForward()
+}
+
+// SeekToFirst positions the iterator at the first key.
+func (it *Iterator) SeekToFirst() {
+	it.Seek(it.opts.LowerBound)
+}
+
+// SeekToLast positions the iterator at the last key.
+func (it *Iterator) SeekToLast() {
+	for _, child := range it.children {
+		if it.opts.UpperBound == "" {
+			child.seekToLast()
+		} else {
+			child.seekBefore(it.opts.UpperBound)
+		}
+	}
+	it.forward = false
+	it.findLargest()
+	it.skipBackward()
+}
+
+// Next moves the iterator to the next key.
+func (it *Iterator) Next() {
+	if !it.Valid() {
+		return
+	}
+	key := it.current.Key
+	if it.forward {
+		// Every child is at or after key, move the ones at key on
+		for _, child := range it.children {
+			if child.valid() && child.entry().Key == key {
+				child.next()
+			}
+		}
+	} else {
+		// Children are before key, move them past it
+		for _, child := range it.children {
+			child.seek(key)
+			if child.valid() && child.entry().Key == key {
+				child.next()
+			}
+		}
+		it.forward = true
+	}
+	it.findSmallest()
+	it.skipForward()
+}
+
+// Prev moves the iterator to the previous key.
+func (it *Iterator) Prev() {
+	if !it.Valid() {
+		return
+	}
+	key := it.current.Key
+	if !it.forward {
+		// Every child is at or before key, move the ones at key back
+		for _, child := range it.children {
+			if child.valid() && child.entry().Key == key {
+				child.prev()
+			}
+		}
+	} else {
+		// Children are at or after key, move them before it
+		for _, child := range it.children {
+			child.seekBefore(key)
+		}
+		it.forward = false
+	}
+	it.findLargest()
+	it.skipBackward()
+}
+
+// Close releases the SST files held by the iterator and returns its error,
+// if any.
+func (it *Iterator) Close() error {
+	if it.closed {
+		return errors.New("Iterator already closed")
+	}
+	it.closed, it.valid = true, false
+	it.children = nil
+	if err := it.mem.unpinTables(it.pinned); err != nil && it.err == nil {
+		it.err = err
+	}
+	return it.err
+}
+
+// findSmallest makes the smallest key of the children current, taking the
+// entry of the newest child that holds it.
+func (it *Iterator) findSmallest() {
+	it.find(func(key, best string) bool { return key < best })
+}
+
+// findLargest makes the largest key of the children current, taking the
+// entry of the newest child that holds it.
+func (it *Iterator) findLargest() {
+	it.find(func(key, best string) bool { return key > best })
+}
+
+func (it *Iterator) find(better func(key, best string) bool) {
+	it.valid = false
+	for _, child := range it.children {
+		if err := child.error(); err != nil {
+			it.err = err
+			return
+		}
+		if !child.valid() {
+			continue
+		}
+		if kv := child.entry(); !it.valid || better(kv.Key, it.current.Key) {
+			it.current, it.valid = kv, true
+		}
+	}
+}
+
+// skipForward moves on past deleted and expired keys, and stops at the upper
+// bound.
+func (it *Iterator) skipForward() {
+	for it.Valid() {
+		if it.opts.UpperBound != "" && it.current.Key >= it.opts.UpperBound {
+			it.valid = false
+			return
+		}
+		if !it.current.Deleted && !it.current.expired(it.now) {
+			return
+		}
+		key := it.current.Key
+		for _, child := range it.children {
+			if child.valid() && child.entry().Key == key {
+				child.next()
+			}
+		}
+		it.findSmallest()
+	}
+}
+
+// skipBackward moves back past deleted and expired keys, and stops at the
+// lower bound.
+func (it *Iterator) skipBackward() {
+	for it.Valid() {
+		if it.current.Key < it.opts.LowerBound {
+			it.valid = false
+			return
+		}
+		if !it.current.Deleted && !it.current.expired(it.now) {
+			return
+		}
+		key := it.current.Key
+		for _, child := range it.children {
+			if child.valid() && child.entry().Key == key {
+				child.prev()
+			}
+		}
+		it.findLargest()
+	}
+}
+
+// versionIterator shows the newest version numbered at most seq of every
+// key of raw, and hides the others.
+type versionIterator struct {
+	raw internalIterator
+	seq uint64
+}
+
+// skipForward moves on to the first visible version, from the newest version
+// of a key.
+func (it *versionIterator) skipForward() {
+	for it.raw.valid() && it.raw.entry().Seq > it.seq {
+		it.raw.next()
+	}
+}
+
+// skipBackward moves back to the newest visible version of a key, from its
+// oldest version. Keys without a visible version are passed over.
+func (it *versionIterator) skipBackward() {
+	for it.raw.valid() {
+		key := it.raw.entry().Key
+		if it.raw.entry().Seq > it.seq {
+			// Every newer version is not visible either
+			for it.raw.valid() && it.raw.entry().Key == key {
+				it.raw.prev()
+			}
+			continue
+		}
+		for {
+			it.raw.prev()
+			if !it.raw.valid() || it.raw.entry().Key != key || it.raw.entry().Seq > it.seq {
+				it.raw.next()
+				return
+			}
+		}
+	}
+}
+
+func (it *versionIterator) seek(key string) {
+	it.raw.seek(key)
+	it.skipForward()
+}
+
+func (it *versionIterator) seekBefore(key string) {
+	it.raw.seekBefore(key)
+	it.skipBackward()
+}
+
+func (it *versionIterator) seekToFirst() {
+	it.raw.seekToFirst()
+	it.skipForward()
+}
+
+func (it *versionIterator) seekToLast() {
+	it.raw.seekToLast()
+	it.skipBackward()
+}
+
+func (it *versionIterator) next() {
+	key := it.raw.entry().Key
+	for it.raw.valid() && it.raw.entry().Key == key {
+		it.raw.next()
+	}
+	it.skipForward()
+}
+
+func (it *versionIterator) prev() {
+	key := it.raw.entry().Key
+	for it.raw.valid() && it.raw.entry().Key == key {
+		it.raw.prev()
+	}
+	it.skipBackward()
+}
+
+func (it *versionIterator) valid() bool     { return it.raw.valid() }
+func (it *versionIterator) entry() KeyValue { return it.raw.entry() }
+func (it *versionIterator) error() error    { return it.raw.error() }
+
+// seekBefore positions child at the last entry before key.
+func seekBefore(child internalIterator, key string) {
+	child.seek(key)
+	if child.valid() {
+		child.prev()
+	} else if child.error() == nil {
+		child.seekToLast()
+	}
+}
+
+// sstIterator walks an SST file in either direction, reading one data block
+// at a time. Legacy files are a single block.
+type sstIterator struct {
+	table *SSTFile
+	index int // Block in table.index, -1 or the block count when out of blocks
+	block []KeyValue
+	pos   int
+	err   error
+}
+
+func (it *sstIterator) blocks() int {
+	if it.table.legacy != nil {
+		return 1
+	}
+	return len(it.table.index)
+}
+
+// loadBlock reads block i and positions the iterator at its first entry.
+func (it *sstIterator) loadBlock(i int) {
+	it.index, it.block, it.pos = i, nil, 0
+	if i < 0 || i >= it.blocks() {
+		return
+	}
+	if it.table.legacy != nil {
+		it.block = it.table.legacy
+		return
+	}
+	block, err := it.table.readBlock(it.table.index[i])
+	if err != nil {
+		it.err = err
+		return
+	}
+	it.block = block
+}
+
+// skipEmptyForward moves to the next block while past the current one.
+func (it *sstIterator) skipEmptyForward() {
+	for it.err == nil && it.index < it.blocks() && it.pos >= len(it.block) {
+		it.loadBlock(it.index + 1)
+	}
+}
+
+// skipEmptyBackward moves to the previous block while before the current one.
+func (it *sstIterator) skipEmptyBackward() {
+	for it.err == nil && it.index >= 0 && it.pos < 0 {
+		it.loadBlock(it.index - 1)
+		it.pos = len(it.block) - 1
+	}
+}
+
+func (it *sstIterator) seek(key string) {
+	// The key can only be in the last block starting at or before it
+	i := 0
+	if it.table.legacy == nil {
+		i = sort.Search(len(it.table.index), func(i int) bool {
+			return it.table.index[i].firstKey > key
+		}) - 1
+		if i < 0 {
+			i = 0
+		}
+	}
+	it.loadBlock(i)
+	it.pos = sort.Search(len(it.block), func(i int) bool {
+		return it.block[i].Key >= key
+	})
+	it.skipEmptyForward()
+}
+
+func (it *sstIterator) seekBefore(key string) { seekBefore(it, key) }
+
+func (it *sstIterator) seekToFirst() {
+	it.loadBlock(0)
+	it.skipEmptyForward()
+}
+
+func (it *sstIterator) seekToLast() {
+	it.loadBlock(it.blocks() - 1)
+	it.pos = len(it.block) - 1
+	it.skipEmptyBackward()
+}
+
+func (it *sstIterator) next() {
+	it.pos++
+	it.skipEmptyForward()
+}
+
+func (it *sstIterator) prev() {
+	it.pos--
+	it.skipEmptyBackward()
+}
+
+func (it *sstIterator) valid() bool {
+	return it.err == nil && it.index >= 0 && it.index < it.blocks() && it.pos >= 0 && it.pos < len(it.block)
+}
+
+func (it *sstIterator) entry() KeyValue { return it.block[it.pos] }
+func (it *sstIterator) error() error    { return it.err }
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// collect reads the iterator from its position on, in the direction given,
+// as key=value pairs.
+func collect(t *testing.T, it *Iterator, forward bool) []string {
+	t.Helper()
+	var pairs []string
+	for it.Valid() {
+		pairs = append(pairs, it.Key()+"="+it.Value())
+		if forward {
+			it.Next()
+		} else {
+			it.Prev()
+		}
+	}
+	if err := it.Error(); err != nil {
+		t.Fatalf("Error iterating: %v", err)
+	}
+	return pairs
+}
+
+func TestIteratorMergesMemtablesAndLevels(t *testing.T) {
+	memDB := openCompactionTestDB(t, t.TempDir())
+	defer memDB.Close()
+
+	// Older values end up compacted into the deeper levels, newer ones in
+	// level 0 and the memtable
+	expected := make(map[string]string)
+	for round := 0; round < 6; round++ {
+		for i := 0; i < 20; i++ {
+			key := "key" + strconv.Itoa(10+(i*7+round)%40)
+			value := "value" + strconv.Itoa(round) + "-" + strconv.Itoa(i)
+			if err := memDB.Set(key, value); err != nil {
+				t.Fatalf("Error setting key-value pair: %v", err)
+			}
+			expected[key] = value
+		}
+		if round == 3 {
+			if err := memDB.waitForFlushes(); err != nil {
+				t.Fatalf("Error flushing memtable: %v", err)
+			}
+			if err := memDB.compact(); err != nil {
+				t.Fatalf("Error compacting: %v", err)
+			}
+		}
+	}
+	for _, key := range []string{"key10", "key25", "key49"} {
+		if _, ok := expected[key]; ok {
+			if _, err := memDB.Del(key); err != nil {
+				t.Fatalf("Error deleting key-value pair: %v", err)
+			}
+			delete(expected, key)
+		}
+	}
+
+	var want []string
+	for i := 10; i < 50; i++ {
+		key := "key" + strconv.Itoa(i)
+		if value, ok := expected[key]; ok {
+			want = append(want, key+"="+value)
+		}
+	}
+
+	it := memDB.NewIterator(IteratorOptions{})
+	defer it.Close()
+	it.SeekToFirst()
+	if got := collect(t, it, true); !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected forward scan %v, got %v", want, got)
+	}
+	it.SeekToLast()
+	got := collect(t, it, false)
+	for i, j := 0, len(got)-1; i < j; i, j = i+1, j-1 {
+		got[i], got[j] = got[j], got[i]
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected backward scan %v, got %v", want, got)
+	}
+}
+
+func TestIteratorSeekAndChangeDirection(t *testing.T) {
+	memDB := openTestDB(t, t.TempDir())
+	defer memDB.Close()
+
+	for _, key := range []string{"a", "c", "e", "g", "i"} {
+		if err := memDB.Set(key, "old-"+key); err != nil {
+			t.Fatalf("Error setting key-value pair: %v", err)
+		}
+	}
+	if err := memDB.Flush(); err != nil {
+		t.Fatalf("Error flushing memtable: %v", err)
+	}
+	if err := memDB.Set("e", "new-e"); err != nil {
+		t.Fatalf("Error setting key-value pair: %v", err)
+	}
+	if err := memDB.Set("f", "new-f"); err != nil {
+		t.Fatalf("Error setting key-value pair: %v", err)
+	}
+	if _, err := memDB.Del("g"); err != nil {
+		t.Fatalf("Error deleting key-value pair: %v", err)
+	}
+
+	it := memDB.NewIterator(IteratorOptions{})
+	defer it.Close()
+
+	it.Seek("d")
+	if !it.Valid() || it.Key() != "e" || it.Value() != "new-e" {
+		t.Fatalf("Expected Seek(d) to land on e=new-e, got %s=%s", it.Key(), it.Value())
+	}
+	it.Next()
+	it.Next()
+	if !it.Valid() || it.Key() != "i" {
+		t.Fatalf("Expected the deleted g to be skipped, got %s", it.Key())
+	}
+	it.Prev()
+	if !it.Valid() || it.Key() != "f" {
+		t.Fatalf("Expected Prev from i to land on f, got %s", it.Key())
+	}
+	it.Prev()
+	it.Prev()
+	if !it.Valid() || it.Key() != "c" || it.Value() != "old-c" {
+		t.Fatalf("Expected c=old-c, got %s=%s", it.Key(), it.Value())
+	}
+	it.Next()
+	if !it.Valid() || it.Key() != "e" {
+		t.Fatalf("Expected Next from c to land on e, got %s", it.Key())
+	}
+
+	it.Seek("j")
+	if it.Valid() {
+		t.Errorf("Expected Seek past the last key to be invalid, got %s", it.Key())
+	}
+}
+
+func TestIteratorBounds(t *testing.T) {
+	memDB := openTestDB(t, t.TempDir())
+	defer memDB.Close()
+
+	for i := 0; i < 10; i++ {
+		if err := memDB.Set("key"+strconv.Itoa(i), "value"+strconv.Itoa(i)); err != nil {
+			t.Fatalf("Error setting key-value pair: %v", err)
+		}
+	}
+
+	it := memDB.NewIterator(IteratorOptions{LowerBound: "key3", UpperBound: "key6"})
+	defer it.Close()
+
+	it.SeekToFirst()
+	want := []string{"key3=value3", "key4=value4", "key5=value5"}
+	if got := collect(t, it, true); !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected %v within bounds, got %v", want, got)
+	}
+	it.SeekToLast()
+	if !it.Valid() || it.Key() != "key5" {
+		t.Errorf("Expected SeekToLast to land on key5, got %s", it.Key())
+	}
+	it.Seek("key0")
+	if !it.Valid() || it.Key() != "key3" {
+		t.Errorf("Expected Seek below the lower bound to land on key3, got %s", it.Key())
+	}
+	it.Prev()
+	if it.Valid() {
+		t.Errorf("Expected Prev past the lower bound to be invalid, got %s", it.Key())
+	}
+}
+
+func TestIteratorKeepsCompactedFiles(t *testing.T) {
+	memDB := openCompactionTestDB(t, t.TempDir())
+	defer memDB.Close()
+
+	const keys = 2 * (threshold + 1)
+	write := func(value string) {
+		for i := 0; i < keys; i++ {
+			if err := memDB.Set("key"+strconv.Itoa(i), value); err != nil {
+				t.Fatalf("Error setting key-value pair: %v", err)
+			}
+		}
+		if err := memDB.waitForFlushes(); err != nil {
+			t.Fatalf("Error flushing memtable: %v", err)
+		}
+		if err := memDB.compact(); err != nil {
+			t.Fatalf("Error compacting: %v", err)
+		}
+	}
+	live := func() map[int]bool {
+		live := make(map[int]bool)
+		for _, meta := range memDB.manifest.Files() {
+			live[meta.Number] = true
+		}
+		return live
+	}
+
+	// The iterator reads from files that the next compaction replaces
+	write("old")
+	it := memDB.NewIterator(IteratorOptions{})
+	write("new")
+
+	replaced := 0
+	current := live()
+	for _, number := range it.pinned {
+		if current[number] {
+			continue
+		}
+		replaced++
+		if _, err := os.Stat(memDB.names.sst(number)); err != nil {
+			t.Errorf("Expected SST file %d to be kept for the iterator, got %v", number, err)
+		}
+	}
+	if replaced == 0 {
+		t.Fatal("Expected the files read by the iterator to be compacted")
+	}
+
+	it.SeekToFirst()
+	got := collect(t, it, true)
+	if len(got) != keys {
+		t.Errorf("Expected %d keys, got %v", keys, got)
+	}
+	for _, pair := range got {
+		if !strings.HasSuffix(pair, "=old") {
+			t.Errorf("Expected the values from when the iterator was created, got %s", pair)
+		}
+	}
+	pinned := it.pinned
+	if err := it.Close(); err != nil {
+		t.Fatalf("Error closing iterator: %v", err)
+	}
+
+	// Replaced files go away once the iterator is closed
+	current = live()
+	for _, number := range pinned {
+		if _, err := os.Stat(memDB.names.sst(number)); current[number] != (err == nil) {
+			t.Errorf("Expected SST file %d to exist only while live, got %v", number, err)
+		}
+	}
+}
+
+func TestIteratorUnpinsFilesAfterOpenError(t *testing.T) {
+	dir := t.TempDir()
+	memDB := openTestDB(t, dir)
+	for i := 0; i < 2*(threshold+1); i++ {
+		if err := memDB.Set("key"+strconv.Itoa(i), "value"); err != nil {
+			t.Fatalf("Error setting key-value pair: %v", err)
+		}
+	}
+	if err := memDB.Flush(); err != nil {
+		t.Fatalf("Error flushing memtable: %v", err)
+	}
+	memDB.Close()
+
+	// Reopen so no file is open yet, then lose the first one read
+	memDB = openTestDB(t, dir)
+	defer memDB.Close()
+	files := memDB.manifest.Files()
+	if len(files) < 2 {
+		t.Fatalf("Expected several SST files, got %d", len(files))
+	}
+	if err := os.Remove(memDB.names.sst(files[0].Number)); err != nil {
+		t.Fatalf("Error removing SST file: %v", err)
+	}
+
+	it := memDB.NewIterator(IteratorOptions{})
+	if it.Error() == nil {
+		t.Fatal("Expected error for a missing SST file, but got nil")
+	}
+	it.Close()
+	memDB.tablesMu.Lock()
+	pinned := len(memDB.pinned)
+	memDB.tablesMu.Unlock()
+	if pinned != 0 {
+		t.Errorf("Expected no pinned files after Close, got %d", pinned)
+	}
+}
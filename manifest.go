@@ -0,0 +1,309 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// manifestMagic starts every MANIFEST file.
+var manifestMagic = []byte("KVMANIF1")
+
+// FileMeta describes an SST file in the live set.
+type FileMeta struct {
+	Number      int    `json:"number"`
+	Level       int    `json:"level"`
+	Smallest    string `json:"smallest"`
+	Largest     string `json:"largest"`
+	SmallestSeq uint64 `json:"smallest_seq"`
+	LargestSeq  uint64 `json:"largest_seq"`
+	Size        int64  `json:"size"`
+}
+
+// VersionEdit is a change to the live set of SST files. Every edit is one
+// record of the MANIFEST. A flush also records the first WAL segment that is
+// still needed and the last sequence number it stored.
+type VersionEdit struct {
+	Added          []FileMeta `json:"added,omitempty"`
+	Deleted        []int      `json:"deleted,omitempty"`
+	NextFileNumber int        `json:"next_file_number,omitempty"`
+	LogNumber      int        `json:"log_number,omitempty"`
+	LastSeq        uint64     `json:"last_seq,omitempty"`
+}
+
+// Manifest is the log of version edits that defines which SST files are
+// live. It is replayed on open to rebuild the file set and the next file
+// number, then rewritten as a single edit so it does not grow forever.
+type Manifest struct {
+	filename       string
+	names          fileNames
+	file           *os.File
+	size           int64 // Offset right after the last intact edit
+	err            error // Set once a torn edit could not be cut off
+	mu             sync.Mutex
+	files          map[int]FileMeta
+	nextFileNumber int
+	logNumber      int    // WAL segments before it are stored in SST files
+	lastSeq        uint64 // Last sequence number stored in SST files
+}
+
+// OpenManifest opens the MANIFEST of a store. When there is none yet, the
+// SST files found in the store directory are adopted as level 0, so stores
+// written before the MANIFEST keep their data.
+func OpenManifest(names fileNames) (*Manifest, error) {
+	m := &Manifest{
+		filename:       names.manifest(),
+		names:          names,
+		files:          make(map[int]FileMeta),
+		nextFileNumber: 1,
+	}
+
+	err := m.replay()
+	if os.IsNotExist(err) {
+		err = m.adoptSSTFiles()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := m.rewrite(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// replay applies every intact edit of the MANIFEST.
+func (m *Manifest) replay() error {
+	file, err := os.Open(m.filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	r := bufio.NewReader(file)
+	header := make([]byte, len(manifestMagic))
+	if _, err := io.ReadFull(r, header); err != nil || !bytes.Equal(header, manifestMagic) {
+		return errors.New("Invalid MANIFEST file format")
+	}
+	for {
+		payload, err := readFrame(r)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		var edit VersionEdit
+		if err := json.Unmarshal(payload, &edit); err != nil {
+			return err
+		}
+		m.apply(edit)
+	}
+}
+
+// adoptSSTFiles builds the live set from the SST files in the directory.
+func (m *Manifest) adoptSSTFiles() error {
+	matches, err := filepath.Glob(m.names.sstGlob())
+	if err != nil {
+		return err
+	}
+
+	for _, match := range matches {
+		number, ok := m.names.parseSST(match)
+		if !ok {
+			continue
+		}
+		meta, err := readFileMeta(match, number)
+		if err != nil {
+			return err
+		}
+		m.apply(VersionEdit{Added: []FileMeta{meta}})
+	}
+	return nil
+}
+
+// rewrite replaces the MANIFEST with a single edit holding the live set.
+func (m *Manifest) rewrite() error {
+	snapshot := VersionEdit{Added: m.Files(), NextFileNumber: m.nextFileNumber, LogNumber: m.logNumber, LastSeq: m.lastSeq}
+	payload, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+
+	tmpname := m.filename + ".tmp"
+	file, err := os.Create(tmpname)
+	if err != nil {
+		return err
+	}
+	data := append(append([]byte(nil), manifestMagic...), frame(payload)...)
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := os.Rename(tmpname, m.filename); err != nil {
+		file.Close()
+		return err
+	}
+	if err := syncDir(filepath.Dir(m.filename)); err != nil {
+		file.Close()
+		return err
+	}
+
+	if m.file != nil {
+		m.file.Close()
+	}
+	m.file = file
+	m.size = int64(len(data))
+	return nil
+}
+
+// Apply appends edit to the MANIFEST, syncs it, then applies it to the live
+// set. An edit is only visible once it is durable. A failed edit is cut off
+// so the ones after it stay readable; if that fails too, every later edit is
+// refused, since replay stops at the first torn one.
+func (m *Manifest) Apply(edit VersionEdit) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.err != nil {
+		return m.err
+	}
+	payload, err := json.Marshal(edit)
+	if err != nil {
+		return err
+	}
+	data := frame(payload)
+	if _, err := m.file.Write(data); err != nil {
+		m.truncate()
+		return err
+	}
+	if err := m.file.Sync(); err != nil {
+		m.truncate()
+		return err
+	}
+	m.size += int64(len(data))
+
+	m.apply(edit)
+	return nil
+}
+
+// truncate cuts off what a failed edit left after the last intact one.
+// m.mu must be held.
+func (m *Manifest) truncate() {
+	if err := m.file.Truncate(m.size); err != nil {
+		m.err = fmt.Errorf("MANIFEST failed: %w", err)
+		return
+	}
+	if _, err := m.file.Seek(m.size, io.SeekStart); err != nil {
+		m.err = fmt.Errorf("MANIFEST failed: %w", err)
+	}
+}
+
+func (m *Manifest) apply(edit VersionEdit) {
+	for _, number := range edit.Deleted {
+		delete(m.files, number)
+	}
+	for _, meta := range edit.Added {
+		m.files[meta.Number] = meta
+		if meta.Number >= m.nextFileNumber {
+			m.nextFileNumber = meta.Number + 1
+		}
+	}
+	if edit.NextFileNumber > m.nextFileNumber {
+		m.nextFileNumber = edit.NextFileNumber
+	}
+	if edit.LogNumber > m.logNumber {
+		m.logNumber = edit.LogNumber
+	}
+	if edit.LastSeq > m.lastSeq {
+		m.lastSeq = edit.LastSeq
+	}
+}
+
+// NewFileNumber reserves the number of a new SST file. Numbers are not
+// reused, even if the file never makes it into the live set.
+func (m *Manifest) NewFileNumber() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	number := m.nextFileNumber
+	m.nextFileNumber++
+	return number
+}
+
+// LogNumber returns the first WAL segment whose records may not be stored in
+// SST files yet.
+func (m *Manifest) LogNumber() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.logNumber
+}
+
+// LastSeq returns the last sequence number stored in SST files.
+func (m *Manifest) LastSeq() uint64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.lastSeq
+}
+
+// Files returns the live SST files in lookup order: by level, and newest
+// first within a level. Files are ordered by the sequence numbers they hold,
+// since a compaction output can have a higher number than a newer flush.
+func (m *Manifest) Files() []FileMeta {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	files := make([]FileMeta, 0, len(m.files))
+	for _, meta := range m.files {
+		files = append(files, meta)
+	}
+	sort.Slice(files, func(i, j int) bool {
+		if files[i].Level != files[j].Level {
+			return files[i].Level < files[j].Level
+		}
+		if files[i].LargestSeq != files[j].LargestSeq {
+			return files[i].LargestSeq > files[j].LargestSeq
+		}
+		return files[i].Number > files[j].Number
+	})
+	return files
+}
+
+// Close closes the MANIFEST file.
+func (m *Manifest) Close() error {
+	return m.file.Close()
+}
+
+// readFileMeta builds the metadata of an existing SST file.
+func readFileMeta(filename string, number int) (FileMeta, error) {
+	s, err := openSSTFile(filename)
+	if err != nil {
+		return FileMeta{}, err
+	}
+	defer s.close()
+
+	info, err := s.file.Stat()
+	if err != nil {
+		return FileMeta{}, err
+	}
+	return FileMeta{
+		Number:   number,
+		Smallest: s.smallestKey,
+		Largest:  s.largestKey,
+		Size:     info.Size(),
+	}, nil
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+func TestManifestReplay(t *testing.T) {
+	opts := DefaultOptions()
+	opts.Dir = t.TempDir()
+	m, err := OpenManifest(opts.fileNames())
+	if err != nil {
+		t.Fatalf("Error opening MANIFEST: %v", err)
+	}
+
+	first, second := m.NewFileNumber(), m.NewFileNumber()
+	edits := []VersionEdit{
+		{Added: []FileMeta{{Number: first, Smallest: "a", Largest: "m", SmallestSeq: 1, LargestSeq: 4}}, NextFileNumber: first + 1},
+		{Added: []FileMeta{{Number: second, Smallest: "b", Largest: "z", SmallestSeq: 5, LargestSeq: 9}}, NextFileNumber: second + 1},
+		{Added: []FileMeta{{Number: 7, Level: 1, Smallest: "a", Largest: "z", SmallestSeq: 1, LargestSeq: 9}}, Deleted: []int{first, second}},
+	}
+	for _, edit := range edits {
+		if err := m.Apply(edit); err != nil {
+			t.Fatalf("Error applying version edit: %v", err)
+		}
+	}
+	m.Close()
+
+	m, err = OpenManifest(opts.fileNames())
+	if err != nil {
+		t.Fatalf("Error reopening MANIFEST: %v", err)
+	}
+	defer m.Close()
+
+	files := m.Files()
+	if len(files) != 1 || files[0] != edits[2].Added[0] {
+		t.Fatalf("Expected only file 7 to be live, got %+v", files)
+	}
+	if number := m.NewFileNumber(); number != 8 {
+		t.Errorf("Expected next file number 8, got %d", number)
+	}
+}
+
+func TestManifestCutsOffFailedEdit(t *testing.T) {
+	opts := DefaultOptions()
+	opts.Dir = t.TempDir()
+	m, err := OpenManifest(opts.fileNames())
+	if err != nil {
+		t.Fatalf("Error opening MANIFEST: %v", err)
+	}
+
+	if err := m.Apply(VersionEdit{Added: []FileMeta{{Number: 1, Smallest: "a", Largest: "m"}}}); err != nil {
+		t.Fatalf("Error applying version edit: %v", err)
+	}
+
+	// Leave half an edit behind, as a short write would, and cut it off the
+	// way a failed Apply does
+	torn := frame([]byte(`{"deleted":[1]}`))
+	if _, err := m.file.Write(torn[:len(torn)/2]); err != nil {
+		t.Fatalf("Error writing torn edit: %v", err)
+	}
+	m.mu.Lock()
+	m.truncate()
+	m.mu.Unlock()
+
+	if err := m.Apply(VersionEdit{Added: []FileMeta{{Number: 2, Smallest: "n", Largest: "z"}}}); err != nil {
+		t.Fatalf("Error applying version edit: %v", err)
+	}
+	m.Close()
+
+	m, err = OpenManifest(opts.fileNames())
+	if err != nil {
+		t.Fatalf("Error reopening MANIFEST: %v", err)
+	}
+	defer m.Close()
+
+	if files := m.Files(); len(files) != 2 {
+		t.Fatalf("Expected the edit after the torn one to be replayed, got %+v", files)
+	}
+}
+
+func TestManifestRefusesEditsAfterFailure(t *testing.T) {
+	opts := DefaultOptions()
+	opts.Dir = t.TempDir()
+	m, err := OpenManifest(opts.fileNames())
+	if err != nil {
+		t.Fatalf("Error opening MANIFEST: %v", err)
+	}
+	defer m.Close()
+
+	// A read-only handle can neither be written nor truncated
+	file, err := os.Open(m.filename)
+	if err != nil {
+		t.Fatalf("Error opening MANIFEST file: %v", err)
+	}
+	m.file.Close()
+	m.file = file
+
+	edit := VersionEdit{Added: []FileMeta{{Number: 1, Smallest: "a", Largest: "z"}}}
+	if err := m.Apply(edit); err == nil {
+		t.Fatal("Expected error applying to a read-only MANIFEST, but got nil")
+	}
+	if m.err == nil {
+		t.Fatal("Expected the MANIFEST to be marked failed")
+	}
+	if err := m.Apply(edit); err != m.err {
+		t.Errorf("Expected later edits to be refused with %v, got %v", m.err, err)
+	}
+	if files := m.Files(); len(files) != 0 {
+		t.Errorf("Expected no live files, got %+v", files)
+	}
+}
+
+func TestManifestAdoptsExistingSSTFiles(t *testing.T) {
+	opts := DefaultOptions()
+	opts.Dir = t.TempDir()
+	names := opts.fileNames()
+	for _, number := range []int{3, 12} {
+		keyValues := []KeyValue{{Key: "key", Value: "value"}}
+		if err := flushSSTFile(names.sst(number), keyValues, defaultBloomBitsPerKey); err != nil {
+			t.Fatalf("Error flushing SST file: %v", err)
+		}
+	}
+
+	m, err := OpenManifest(names)
+	if err != nil {
+		t.Fatalf("Error opening MANIFEST: %v", err)
+	}
+	defer m.Close()
+
+	files := m.Files()
+	if len(files) != 2 || files[0].Number != 12 || files[1].Number != 3 {
+		t.Fatalf("Expected files 12 and 3 to be adopted, got %+v", files)
+	}
+	if files[0].Smallest != "key" || files[0].Largest != "key" {
+		t.Errorf("Expected key range key..key, got %s..%s", files[0].Smallest, files[0].Largest)
+	}
+	if number := m.NewFileNumber(); number != 13 {
+		t.Errorf("Expected next file number 13, got %d", number)
+	}
+	if _, err := os.Stat(names.manifest()); err != nil {
+		t.Errorf("Expected a MANIFEST to be written: %v", err)
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Options configures a store opened with Open. Zero fields take the value
+// from DefaultOptions.
+type Options struct {
+	// Dir is the directory holding the WAL segments, the MANIFEST and the
+	// SST files. The dir argument of Open takes precedence.
+	Dir string
+
+	// MemtableSize is the approximate number of bytes the memtable may use
+	// before it is flushed to an SST file. Every entry counts its key, its
+	// value and a fixed overhead.
+	MemtableSize int64
+
+	// MaxImmutableMemtables is the number of full memtables that may wait for
+	// a flush before writers stall.
+	MaxImmutableMemtables int
+
+	// MemtableType selects the memtable implementation, see MemtableType.
+	MemtableType MemtableType
+
+	// SyncPolicy and SyncInterval control when the WAL is fsynced, see
+	// SyncPolicy. SyncInterval is only used by SyncInterval.
+	SyncPolicy   SyncPolicy
+	SyncInterval time.Duration
+
+	// BloomBitsPerKey is the bloom filter size for new SST files. A negative
+	// value disables the filters.
+	BloomBitsPerKey int
+
+	// CompactionStyle selects the compaction strategy, see CompactionStyle.
+	CompactionStyle CompactionStyle
+
+	// L0CompactionTrigger is the number of level 0 files that starts a
+	// compaction into level 1.
+	L0CompactionTrigger int
+
+	// LevelSizeBase is the size level 1 may reach before it is compacted into
+	// level 2. Every deeper level may grow LevelSizeMultiplier times larger.
+	LevelSizeBase       int64
+	LevelSizeMultiplier int
+
+	// NumLevels is the number of levels, level 0 included. The last level is
+	// never compacted.
+	NumLevels int
+
+	// TargetFileSize is the size at which leveled compaction starts a new
+	// output file. Size-tiered compaction writes every run to a single file.
+	TargetFileSize int64
+
+	// SizeTieredMinFiles and SizeTieredMaxFiles bound the number of similarly
+	// sized files merged by one size-tiered compaction.
+	SizeTieredMinFiles int
+	SizeTieredMaxFiles int
+
+	// TTLSweepInterval is how often expired values are swept from the
+	// memtable, see MemDB.SetWithTTL. A negative value disables the sweeper,
+	// and expired values are then only dropped by flushes and compactions.
+	TTLSweepInterval time.Duration
+
+	// WALName is the base name of the WAL segments, such as wal.000001.
+	// SSTPrefix and SSTSuffix name SST files around their file number, such
+	// as mohieddine_12.sst.
+	WALName   string
+	SSTPrefix string
+	SSTSuffix string
+
+	// ListenAddr is the address the HTTP server listens on.
+	ListenAddr string
+}
+
+// DefaultOptions returns the options used for the fields left empty.
+func DefaultOptions() Options {
+	return Options{
+		Dir: ".",
+
+		MemtableSize:          4 << 20,
+		MaxImmutableMemtables: 2,
+
+		SyncPolicy:      SyncAlways,
+		SyncInterval:    100 * time.Millisecond,
+		BloomBitsPerKey: defaultBloomBitsPerKey,
+
+		L0CompactionTrigger: 4,
+		LevelSizeBase:       10 << 20,
+		LevelSizeMultiplier: 10,
+		NumLevels:           7,
+		TargetFileSize:      2 << 20,
+		SizeTieredMinFiles:  4,
+		SizeTieredMaxFiles:  32,
+		TTLSweepInterval:    10 * time.Second,
+
+		WALName:    "wal",
+		SSTPrefix:  "mohieddine_", // Adjust the naming convention as needed
+		SSTSuffix:  ".sst",
+		ListenAddr: ":8080",
+	}
+}
+
+// withDefaults fills the empty fields of opts from DefaultOptions.
+func (opts Options) withDefaults() Options {
+	defaults := DefaultOptions()
+	if opts.Dir == "" {
+		opts.Dir = defaults.Dir
+	}
+	if opts.MemtableSize <= 0 {
+		opts.MemtableSize = defaults.MemtableSize
+	}
+	if opts.MaxImmutableMemtables <= 0 {
+		opts.MaxImmutableMemtables = defaults.MaxImmutableMemtables
+	}
+	if opts.SyncInterval <= 0 {
+		opts.SyncInterval = defaults.SyncInterval
+	}
+	if opts.BloomBitsPerKey == 0 {
+		opts.BloomBitsPerKey = defaults.BloomBitsPerKey
+	}
+	if opts.L0CompactionTrigger <= 0 {
+		opts.L0CompactionTrigger = defaults.L0CompactionTrigger
+	}
+	if opts.LevelSizeBase <= 0 {
+		opts.LevelSizeBase = defaults.LevelSizeBase
+	}
+	if opts.LevelSizeMultiplier <= 1 {
+		opts.LevelSizeMultiplier = defaults.LevelSizeMultiplier
+	}
+	if opts.NumLevels < 2 {
+		opts.NumLevels = defaults.NumLevels
+	}
+	if opts.TargetFileSize <= 0 {
+		opts.TargetFileSize = defaults.TargetFileSize
+	}
+	if opts.SizeTieredMinFiles < 2 {
+		opts.SizeTieredMinFiles = defaults.SizeTieredMinFiles
+	}
+	if opts.SizeTieredMaxFiles < opts.SizeTieredMinFiles {
+		opts.SizeTieredMaxFiles = defaults.SizeTieredMaxFiles
+	}
+	if opts.TTLSweepInterval == 0 {
+		opts.TTLSweepInterval = defaults.TTLSweepInterval
+	}
+	if opts.WALName == "" {
+		opts.WALName = defaults.WALName
+	}
+	if opts.SSTPrefix == "" {
+		opts.SSTPrefix = defaults.SSTPrefix
+	}
+	if opts.SSTSuffix == "" {
+		opts.SSTSuffix = defaults.SSTSuffix
+	}
+	if opts.ListenAddr == "" {
+		opts.ListenAddr = defaults.ListenAddr
+	}
+	return opts
+}
+
+// fileNames builds the paths of the files of a store.
+type fileNames struct {
+	dir       string
+	walName   string
+	sstPrefix string
+	sstSuffix string
+}
+
+func (opts Options) fileNames() fileNames {
+	return fileNames{
+		dir:       opts.Dir,
+		walName:   opts.WALName,
+		sstPrefix: opts.SSTPrefix,
+		sstSuffix: opts.SSTSuffix,
+	}
+}
+
+// wal returns the base path of the WAL segments.
+func (n fileNames) wal() string {
+	return filepath.Join(n.dir, n.walName)
+}
+
+// manifest returns the path of the MANIFEST.
+func (n fileNames) manifest() string {
+	return filepath.Join(n.dir, "MANIFEST")
+}
+
+// sst returns the path of the SST file with the given number.
+func (n fileNames) sst(number int) string {
+	return filepath.Join(n.dir, n.sstPrefix+strconv.Itoa(number)+n.sstSuffix)
+}
+
+// sstGlob returns a pattern matching every SST file of the store.
+func (n fileNames) sstGlob() string {
+	return filepath.Join(n.dir, n.sstPrefix+"*"+n.sstSuffix)
+}
+
+// parseSST returns the file number of an SST file path.
+func (n fileNames) parseSST(path string) (int, bool) {
+	name := filepath.Base(path)
+	if !strings.HasPrefix(name, n.sstPrefix) || !strings.HasSuffix(name, n.sstSuffix) {
+		return 0, false
+	}
+	number, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(name, n.sstPrefix), n.sstSuffix))
+	if err != nil || number < 0 {
+		return 0, false
+	}
+	return number, true
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"sync/atomic"
+)
+
+const (
+	skiplistMaxHeight = 12
+	skiplistBranching = 4 // Each level links about one in four nodes of the level below
+)
+
+// Skiplist is a memtable kept as a skiplist with a node per version, ordered
+// by lessKeyValue. Inserts take O(log n) and keys are iterated in order. It
+// supports any number of readers running concurrently with a single writer:
+// nodes are fully built before they are linked in, links are published
+// atomically, and nodes are never removed.
+type Skiplist struct {
+	head   *skiplistNode
+	height int32 // Number of levels in use, read atomically
+	length int64 // Number of versions, read atomically
+	size   int64 // Approximate bytes used, read atomically
+	rnd    *rand.Rand
+}
+
+type skiplistNode struct {
+	key   string
+	seq   uint64
+	value atomic.Pointer[ValueMarkerPair]
+	next  []atomic.Pointer[skiplistNode]
+}
+
+func newSkiplistNode(key string, seq uint64, height int) *skiplistNode {
+	return &skiplistNode{key: key, seq: seq, next: make([]atomic.Pointer[skiplistNode], height)}
+}
+
+// before reports whether the node comes before the version seq of key.
+func (node *skiplistNode) before(key string, seq uint64) bool {
+	return node.key < key || (node.key == key && node.seq > seq)
+}
+
+func NewSkiplist() *Skiplist {
+	return &Skiplist{
+		head:   newSkiplistNode("", 0, skiplistMaxHeight),
+		height: 1,
+		rnd:    rand.New(rand.NewSource(0xdeadbeef)),
+	}
+}
+
+func (list *Skiplist) randomHeight() int {
+	height := 1
+	for height < skiplistMaxHeight && list.rnd.Intn(skiplistBranching) == 0 {
+		height++
+	}
+	return height
+}
+
+// findGreaterOrEqual returns the first node that is not before the version
+// seq of key: the newest version of key numbered at most seq, if there is
+// one. When prev is not nil, it is filled with the last node before it on
+// every level.
+func (list *Skiplist) findGreaterOrEqual(key string, seq uint64, prev []*skiplistNode) *skiplistNode {
+	node := list.head
+	for level := int(atomic.LoadInt32(&list.height)) - 1; level >= 0; level-- {
+		next := node.next[level].Load()
+		for next != nil && next.before(key, seq) {
+			node, next = next, next.next[level].Load()
+		}
+		if prev != nil {
+			prev[level] = node
+		}
+		if level == 0 {
+			return next
+		}
+	}
+	return nil
+}
+
+// Set inserts the version seq of key. Only one goroutine may call Set at a
+// time.
+func (list *Skiplist) Set(key string, value string, marker bool, seq uint64, expiresAt int64) {
+	pair := &ValueMarkerPair{Value: value, Marker: marker, Seq: seq, ExpiresAt: expiresAt}
+
+	var prev [skiplistMaxHeight]*skiplistNode
+	node := list.findGreaterOrEqual(key, seq, prev[:])
+	if node != nil && node.key == key && node.seq == seq {
+		old := node.value.Swap(pair)
+		atomic.AddInt64(&list.size, int64(len(value)-len(old.Value)))
+		return
+	}
+
+	height := list.randomHeight()
+	if current := int(atomic.LoadInt32(&list.height)); height > current {
+		for level := current; level < height; level++ {
+			prev[level] = list.head
+		}
+		// Readers that see the new height before the new links just move
+		// down from the head sooner
+		atomic.StoreInt32(&list.height, int32(height))
+	}
+
+	node = newSkiplistNode(key, seq, height)
+	node.value.Store(pair)
+	for level := 0; level < height; level++ {
+		node.next[level].Store(prev[level].next[level].Load())
+		prev[level].next[level].Store(node)
+	}
+	atomic.AddInt64(&list.length, 1)
+	atomic.AddInt64(&list.size, entrySize(key, value))
+}
+
+// findLessThan returns the last node before the version seq of key, or the
+// head if there is none.
+func (list *Skiplist) findLessThan(key string, seq uint64) *skiplistNode {
+	node := list.head
+	for level := int(atomic.LoadInt32(&list.height)) - 1; level >= 0; level-- {
+		for next := node.next[level].Load(); next != nil && next.before(key, seq); next = node.next[level].Load() {
+			node = next
+		}
+	}
+	return node
+}
+
+// findLast returns the last node, or the head if the list is empty.
+func (list *Skiplist) findLast() *skiplistNode {
+	node := list.head
+	for level := int(atomic.LoadInt32(&list.height)) - 1; level >= 0; level-- {
+		for next := node.next[level].Load(); next != nil; next = node.next[level].Load() {
+			node = next
+		}
+	}
+	return node
+}
+
+// Lookup returns the value and marker of the newest version of key numbered
+// at most seq, including deleted entries, and whether there is one at all.
+func (list *Skiplist) Lookup(key string, seq uint64) (ValueMarkerPair, bool) {
+	node := list.findGreaterOrEqual(key, seq, nil)
+	if node == nil || node.key != key {
+		return ValueMarkerPair{}, false
+	}
+	return *node.value.Load(), true
+}
+
+// Len returns the number of versions, deleted ones included.
+func (list *Skiplist) Len() int {
+	return int(atomic.LoadInt64(&list.length))
+}
+
+// ApproximateSize returns the bytes used by the entries, see entrySize.
+func (list *Skiplist) ApproximateSize() int64 {
+	return atomic.LoadInt64(&list.size)
+}
+
+// GetKeyValues returns every version in key order, newest first for each
+// key, tombstones included.
+func (list *Skiplist) GetKeyValues() []KeyValue {
+	keyValues := make([]KeyValue, 0, list.Len())
+	for node := list.head.next[0].Load(); node != nil; node = node.next[0].Load() {
+		pair := node.value.Load()
+		keyValues = append(keyValues, KeyValue{Key: node.key, Value: pair.Value, Deleted: !pair.Marker, Seq: node.seq, ExpiresAt: pair.ExpiresAt})
+	}
+	return keyValues
+}
+
+// NewIterator returns an iterator over the versions of the list. Moving
+// forward follows the links of the bottom level, moving back searches from
+// the head, as there are no back links.
+func (list *Skiplist) NewIterator() internalIterator {
+	return &skiplistIterator{list: list}
+}
+
+// skiplistIterator walks a Skiplist. It is at the head when moved back past
+// the first node, and at nil when moved on past the last, so it can step
+// back in from either side.
+type skiplistIterator struct {
+	list *Skiplist
+	node *skiplistNode
+}
+
+func (it *skiplistIterator) seek(key string) {
+	it.node = it.list.findGreaterOrEqual(key, math.MaxUint64, nil)
+}
+
+func (it *skiplistIterator) seekBefore(key string) {
+	it.node = it.list.findLessThan(key, math.MaxUint64)
+}
+
+func (it *skiplistIterator) seekToFirst() { it.node = it.list.head.next[0].Load() }
+func (it *skiplistIterator) seekToLast()  { it.node = it.list.findLast() }
+func (it *skiplistIterator) valid() bool  { return it.node != nil && it.node != it.list.head }
+func (it *skiplistIterator) error() error { return nil }
+
+func (it *skiplistIterator) next() {
+	if it.node != nil {
+		it.node = it.node.next[0].Load()
+	}
+}
+
+func (it *skiplistIterator) prev() {
+	switch it.node {
+	case nil:
+		it.node = it.list.findLast()
+	case it.list.head:
+	default:
+		it.node = it.list.findLessThan(it.node.key, it.node.seq)
+	}
+}
+
+func (it *skiplistIterator) entry() KeyValue {
+	pair := it.node.value.Load()
+	return KeyValue{Key: it.node.key, Value: pair.Value, Deleted: !pair.Marker, Seq: it.node.seq, ExpiresAt: pair.ExpiresAt}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"math"
+	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestMemtableImplementations(t *testing.T) {
+	for _, memtableType := range []MemtableType{SkiplistMemtable, SortedSliceMemtable} {
+		memtable := newMemtable(memtableType)
+
+		var keys []string
+		for i := 0; i < 500; i++ {
+			key := "key" + strconv.Itoa((i*7919)%500)
+			memtable.Set(key, "old", true, uint64(i+1), 0)
+			keys = append(keys, key)
+		}
+		memtable.Set("key42", "new", true, 1000, 0)
+		memtable.Set("key7", "", false, 1001, 0)
+
+		if memtable.Len() != 502 {
+			t.Errorf("Expected 502 versions in memtable %d, got %d", memtableType, memtable.Len())
+		}
+		if pair, ok := memtable.Lookup("key42", math.MaxUint64); !ok || pair.Value != "new" || !pair.Marker || pair.Seq != 1000 {
+			t.Errorf("Expected the updated value of key42 in memtable %d, got %+v", memtableType, pair)
+		}
+		if pair, ok := memtable.Lookup("key42", 999); !ok || pair.Value != "old" {
+			t.Errorf("Expected the old value of key42 before its update in memtable %d, got %+v", memtableType, pair)
+		}
+		if pair, ok := memtable.Lookup("key7", math.MaxUint64); !ok || pair.Marker {
+			t.Errorf("Expected a tombstone for key7 in memtable %d, got %+v", memtableType, pair)
+		}
+		if _, ok := memtable.Lookup("missing", math.MaxUint64); ok {
+			t.Errorf("Expected no entry for a missing key in memtable %d", memtableType)
+		}
+		if _, ok := memtable.Lookup("key42", 0); ok {
+			t.Errorf("Expected no version of key42 before it was written in memtable %d", memtableType)
+		}
+
+		sort.Strings(keys)
+		keyValues := memtable.GetKeyValues()
+		if len(keyValues) != len(keys)+2 {
+			t.Fatalf("Expected %d entries in memtable %d, got %d", len(keys)+2, memtableType, len(keyValues))
+		}
+		for i := 1; i < len(keyValues); i++ {
+			if !lessKeyValue(keyValues[i-1], keyValues[i]) {
+				t.Fatalf("Expected %+v before %+v in memtable %d", keyValues[i-1], keyValues[i], memtableType)
+			}
+		}
+	}
+}
+
+func TestMemtableIterators(t *testing.T) {
+	for _, memtableType := range []MemtableType{SkiplistMemtable, SortedSliceMemtable} {
+		memtable := newMemtable(memtableType)
+		it := memtable.NewIterator()
+		if it.seekToFirst(); it.valid() {
+			t.Errorf("Expected an empty memtable %d to have no entries", memtableType)
+		}
+
+		for i := 0; i < 300; i++ {
+			key := "key" + strconv.Itoa((i*7)%100)
+			memtable.Set(key, "value"+strconv.Itoa(i), i%5 != 0, uint64(i+1), 0)
+		}
+		expected := memtable.GetKeyValues()
+
+		// Both directions see every version, in the order of GetKeyValues
+		var forward, backward []KeyValue
+		for it.seekToFirst(); it.valid(); it.next() {
+			forward = append(forward, it.entry())
+		}
+		for it.seekToLast(); it.valid(); it.prev() {
+			backward = append([]KeyValue{it.entry()}, backward...)
+		}
+		if !reflect.DeepEqual(forward, expected) || !reflect.DeepEqual(backward, expected) {
+			t.Errorf("Expected the iterators of memtable %d to return every version in order", memtableType)
+		}
+
+		i := sort.Search(len(expected), func(i int) bool {
+			return expected[i].Key >= "key50"
+		})
+		if it.seek("key50"); !it.valid() || it.entry() != expected[i] {
+			t.Errorf("Expected seek to the newest version of key50 in memtable %d, got %+v", memtableType, it.entry())
+		}
+		if it.seekBefore("key50"); !it.valid() || it.entry() != expected[i-1] {
+			t.Errorf("Expected seek to the oldest version of key5 in memtable %d, got %+v", memtableType, it.entry())
+		}
+
+		// Stepping off either end and back returns to the same entry
+		it.seekToFirst()
+		if it.prev(); it.valid() {
+			t.Errorf("Expected nothing before the first entry of memtable %d", memtableType)
+		}
+		if it.next(); !it.valid() || it.entry() != expected[0] {
+			t.Errorf("Expected to step back to the first entry of memtable %d, got %+v", memtableType, it.entry())
+		}
+		it.seekToLast()
+		if it.next(); it.valid() {
+			t.Errorf("Expected nothing after the last entry of memtable %d", memtableType)
+		}
+		if it.prev(); !it.valid() || it.entry() != expected[len(expected)-1] {
+			t.Errorf("Expected to step back to the last entry of memtable %d, got %+v", memtableType, it.entry())
+		}
+
+		// Versions set later are seen in their place
+		it.seek("key50")
+		memtable.Set("key50", "newer", true, 1000, 0)
+		if it.prev(); !it.valid() || it.entry().Seq != 1000 {
+			t.Errorf("Expected the version set after seeking in memtable %d, got %+v", memtableType, it.entry())
+		}
+	}
+}
+
+func TestSkiplistConcurrentReaders(t *testing.T) {
+	list := NewSkiplist()
+
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+
+				// A key seen once must stay visible, in order
+				keyValues := list.GetKeyValues()
+				for i := 1; i < len(keyValues); i++ {
+					if keyValues[i-1].Key >= keyValues[i].Key {
+						t.Errorf("Expected keys in order, got %s before %s", keyValues[i-1].Key, keyValues[i].Key)
+						return
+					}
+				}
+				for _, kv := range keyValues {
+					if _, ok := list.Lookup(kv.Key, math.MaxUint64); !ok {
+						t.Errorf("Expected %s to be found", kv.Key)
+						return
+					}
+				}
+			}
+		}()
+	}
+
+	for i := 0; i < 2000; i++ {
+		list.Set("key"+strconv.Itoa(i), "value", true, uint64(i+1), 0)
+	}
+	close(done)
+	wg.Wait()
+
+	if list.Len() != 2000 {
+		t.Errorf("Expected 2000 keys, got %d", list.Len())
+	}
+}
+
+func TestMemDBSortedSliceMemtable(t *testing.T) {
+	opts := testOptions()
+	opts.MemtableType = SortedSliceMemtable
+	memDB, err := Open(t.TempDir(), opts)
+	if err != nil {
+		t.Fatalf("Error opening MemDB: %v", err)
+	}
+	defer memDB.Close()
+
+	if _, ok := memDB.memtable.(*SortedKeyValueStore); !ok {
+		t.Fatalf("Expected a SortedKeyValueStore memtable, got %T", memDB.memtable)
+	}
+	for i := 0; i <= threshold+1; i++ {
+		if err := memDB.Set("key"+strconv.Itoa(i), "value"+strconv.Itoa(i)); err != nil {
+			t.Fatalf("Error setting key-value pair: %v", err)
+		}
+	}
+	for i := 0; i <= threshold+1; i++ {
+		if result, err := memDB.Get("key" + strconv.Itoa(i)); err != nil || result != "value"+strconv.Itoa(i) {
+			t.Errorf("Expected value%d for key%d, got %q (%v)", i, i, result, err)
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"sync/atomic"
+)
+
+// Every write gets the next sequence number, which is stored with it in the
+// WAL, the memtable and the SST files. A key can have several versions, and
+// a reader at sequence number n sees the newest version of every key that is
+// numbered at most n.
+
+// Snapshot is a consistent view of the store as of the moment it was taken.
+// Reads through it ignore every later write, and compaction keeps the
+// versions it can see until it is released. Reads through a snapshot may
+// run concurrently, but not with its Release.
+type Snapshot struct {
+	mem      *MemDB
+	seq      uint64
+	released bool
+}
+
+// Snapshot takes a snapshot at the last write applied so far. It must be
+// released once it is no longer needed, since it keeps old versions around.
+func (mem *MemDB) Snapshot() *Snapshot {
+	mem.snapshotsMu.Lock()
+	defer mem.snapshotsMu.Unlock()
+
+	seq := atomic.LoadUint64(&mem.visibleSeq)
+	mem.snapshots[seq]++
+	return &Snapshot{mem: mem, seq: seq}
+}
+
+// Seq returns the sequence number of the last write the snapshot sees.
+func (snap *Snapshot) Seq() uint64 {
+	return snap.seq
+}
+
+// Get gets the value key had when the snapshot was taken.
+func (snap *Snapshot) Get(key string) (string, error) {
+	if snap.released {
+		return "", errors.New("Snapshot released")
+	}
+	return snap.mem.get(key, snap.seq)
+}
+
+// NewIterator returns an iterator over the store as it was when the
+// snapshot was taken.
+func (snap *Snapshot) NewIterator(opts IteratorOptions) *Iterator {
+	it := snap.mem.newIterator(opts, snap.seq)
+	if snap.released {
+		it.err = errors.New("Snapshot released")
+	}
+	return it
+}
+
+// Release lets compaction drop the versions only the snapshot could see.
+func (snap *Snapshot) Release() {
+	if snap.released {
+		return
+	}
+	snap.released = true
+
+	mem := snap.mem
+	mem.snapshotsMu.Lock()
+	defer mem.snapshotsMu.Unlock()
+	if mem.snapshots[snap.seq]--; mem.snapshots[snap.seq] == 0 {
+		delete(mem.snapshots, snap.seq)
+	}
+}
+
+// liveSnapshots returns the sequence numbers of the live snapshots, oldest
+// first.
+func (mem *MemDB) liveSnapshots() []uint64 {
+	mem.snapshotsMu.Lock()
+	defer mem.snapshotsMu.Unlock()
+
+	seqs := make([]uint64, 0, len(mem.snapshots))
+	for seq := range mem.snapshots {
+		seqs = append(seqs, seq)
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+	return seqs
+}
+
+// versionFilter drops the versions that no reader can see any more: those
+// with a newer version of the same key that every snapshot seeing them also
+// sees. Entries must be passed in the order of lessKeyValue.
+//
+// Snapshots taken after the filter was made see the newest version of every
+// key, which is always kept.
+type versionFilter struct {
+	snapshots []uint64 // Oldest first
+	key       string
+	stripe    int
+	started   bool
+}
+
+func newVersionFilter(snapshots []uint64) *versionFilter {
+	return &versionFilter{snapshots: snapshots}
+}
+
+// stripeOf returns the number of snapshots that are too old to see seq.
+// Versions in the same stripe are seen by the same snapshots.
+func (f *versionFilter) stripeOf(seq uint64) int {
+	return sort.Search(len(f.snapshots), func(i int) bool {
+		return f.snapshots[i] >= seq
+	})
+}
+
+// keep reports whether kv is still needed by a reader.
+func (f *versionFilter) keep(kv KeyValue) bool {
+	stripe := f.stripeOf(kv.Seq)
+	if !f.started || kv.Key != f.key {
+		f.key, f.stripe, f.started = kv.Key, stripe, true
+		return true
+	}
+	if stripe == f.stripe {
+		return false
+	}
+	f.stripe = stripe
+	return true
+}
+
+// visibleToAll reports whether every snapshot sees kv. A tombstone seen by
+// all of them is only needed while older files hold the key.
+func (f *versionFilter) visibleToAll(kv KeyValue) bool {
+	return f.stripeOf(kv.Seq) == 0
+}
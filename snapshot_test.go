@@ -0,0 +1,161 @@
+package main
+
+import (
+	"math"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func TestSnapshotSeesPointInTime(t *testing.T) {
+	memDB := openCompactionTestDB(t, t.TempDir())
+	defer memDB.Close()
+
+	for _, key := range []string{"a", "b"} {
+		if err := memDB.Set(key, "old-"+key); err != nil {
+			t.Fatalf("Error setting key-value pair: %v", err)
+		}
+	}
+	snap := memDB.Snapshot()
+	if err := memDB.Set("a", "new-a"); err != nil {
+		t.Fatalf("Error setting key-value pair: %v", err)
+	}
+	if _, err := memDB.Del("b"); err != nil {
+		t.Fatalf("Error deleting key-value pair: %v", err)
+	}
+	if err := memDB.Set("c", "new-c"); err != nil {
+		t.Fatalf("Error setting key-value pair: %v", err)
+	}
+
+	check := func(stage string) {
+		t.Helper()
+		if result, err := snap.Get("a"); err != nil || result != "old-a" {
+			t.Errorf("Expected old-a from the snapshot %s, got %q (%v)", stage, result, err)
+		}
+		if result, err := snap.Get("b"); err != nil || result != "old-b" {
+			t.Errorf("Expected old-b from the snapshot %s, got %q (%v)", stage, result, err)
+		}
+		if _, err := snap.Get("c"); err == nil {
+			t.Errorf("Expected c to be missing from the snapshot %s", stage)
+		}
+		if result, err := memDB.Get("a"); err != nil || result != "new-a" {
+			t.Errorf("Expected new-a from the store %s, got %q (%v)", stage, result, err)
+		}
+
+		it := snap.NewIterator(IteratorOptions{})
+		defer it.Close()
+		it.SeekToFirst()
+		if got, want := collect(t, it, true), []string{"a=old-a", "b=old-b"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("Expected %v from the snapshot iterator %s, got %v", want, stage, got)
+		}
+		it.SeekToLast()
+		if got, want := collect(t, it, false), []string{"b=old-b", "a=old-a"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("Expected %v from the snapshot iterator backwards %s, got %v", want, stage, got)
+		}
+	}
+	check("in the memtable")
+
+	// Push the old versions through flushes and compactions
+	for round := 0; round < 4; round++ {
+		for _, key := range []string{"a", "x", "y", "z"} {
+			if err := memDB.Set(key, "round"+strconv.Itoa(round)); err != nil {
+				t.Fatalf("Error setting key-value pair: %v", err)
+			}
+		}
+	}
+	if err := memDB.Set("a", "new-a"); err != nil {
+		t.Fatalf("Error setting key-value pair: %v", err)
+	}
+	if err := memDB.Flush(); err != nil {
+		t.Fatalf("Error flushing memtable: %v", err)
+	}
+	if err := memDB.compact(); err != nil {
+		t.Fatalf("Error compacting: %v", err)
+	}
+	if memDB.Stats().Compactions == 0 {
+		t.Fatal("Expected compactions to run")
+	}
+	check("after compaction")
+
+	snap.Release()
+	if _, err := snap.Get("a"); err == nil {
+		t.Error("Expected an error reading a released snapshot")
+	}
+	if seqs := memDB.liveSnapshots(); len(seqs) != 0 {
+		t.Errorf("Expected no live snapshots after the release, got %v", seqs)
+	}
+}
+
+func TestFlushKeepsVersionsForSnapshots(t *testing.T) {
+	memDB := openTestDB(t, t.TempDir())
+	defer memDB.Close()
+
+	// versions returns the entries of key in the newest SST file
+	versions := func() []string {
+		t.Helper()
+		if err := memDB.Flush(); err != nil {
+			t.Fatalf("Error flushing memtable: %v", err)
+		}
+		files := memDB.manifest.Files()
+		keyValues, _, _, err := parseSSTFile(memDB.names.sst(files[0].Number))
+		if err != nil {
+			t.Fatalf("Error parsing SST file: %v", err)
+		}
+		var values []string
+		for _, kv := range keyValues {
+			if kv.Key == "key" {
+				values = append(values, kv.Value)
+			}
+		}
+		return values
+	}
+
+	set := func(values ...string) {
+		t.Helper()
+		for _, value := range values {
+			if err := memDB.Set("key", value); err != nil {
+				t.Fatalf("Error setting key-value pair: %v", err)
+			}
+		}
+	}
+
+	set("v1", "v2")
+	snap := memDB.Snapshot()
+	set("v3", "v4")
+	if got, want := versions(), []string{"v4", "v2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected versions %v with a snapshot, got %v", want, got)
+	}
+	if result, err := snap.Get("key"); err != nil || result != "v2" {
+		t.Errorf("Expected v2 from the snapshot, got %q (%v)", result, err)
+	}
+	snap.Release()
+
+	set("v5", "v6")
+	if got, want := versions(), []string{"v6"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected versions %v without snapshots, got %v", want, got)
+	}
+}
+
+func TestVersionFilter(t *testing.T) {
+	filter := newVersionFilter([]uint64{5, 10})
+
+	// Each snapshot keeps the newest version it sees
+	var kept []uint64
+	for _, seq := range []uint64{12, 11, 9, 7, 4, 3} {
+		if filter.keep(KeyValue{Key: "a", Seq: seq}) {
+			kept = append(kept, seq)
+		}
+	}
+	if want := []uint64{12, 9, 4}; !reflect.DeepEqual(kept, want) {
+		t.Errorf("Expected versions %v to be kept, got %v", want, kept)
+	}
+	if !filter.keep(KeyValue{Key: "b", Seq: 2}) {
+		t.Error("Expected the newest version of another key to be kept")
+	}
+	if filter.visibleToAll(KeyValue{Key: "b", Seq: 6}) || !filter.visibleToAll(KeyValue{Key: "b", Seq: 5}) {
+		t.Error("Expected only versions up to the oldest snapshot to be visible to all")
+	}
+	if !newVersionFilter(nil).visibleToAll(KeyValue{Key: "c", Seq: math.MaxUint64}) {
+		t.Error("Expected every version to be visible to all without snapshots")
+	}
+}
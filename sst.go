@@ -1,63 +1,463 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"encoding/binary"
 	"errors"
+	"fmt"
+	"hash/crc32"
 	"io"
 	"os"
+	"path/filepath"
 	"sort"
 )
 
 const (
-	magicNumber uint64 = 0x6973656D
+	magicNumber      uint64 = 0x6973656D
+	typedMagicNumber uint64 = 0x3173656D
+	blockMagicNumber uint64 = 0x3273656D
 )
 
+// Entry kinds written in front of every value in typed SST files. Files
+// with the original magicNumber header only hold live values. An expiring
+// value, from format version 6 on, has its expiry time after its sequence
+// number.
+const (
+	entryValue     byte = 0
+	entryTombstone byte = 1
+	entryExpiring  byte = 2
+)
+
+const (
+	// sstBlockSize is the size a data block is filled up to before a new
+	// one is started. A point lookup reads a single block.
+	sstBlockSize = 4096
+
+	// sstFormatVersion is written in the footer of block-based SST files.
+	// Version 2 files have no filter block, versions before 4 have no
+	// checksums, versions before 5 have no sequence numbers and versions
+	// before 6 have no expiring values.
+	sstFormatVersion uint32 = 6
+
+	// sstTrailerSize is the size of the format version and magic number
+	// that end the footer of every block-based SST file.
+	sstTrailerSize = 4 + 8
+
+	// sstChecksumSize is the size of the CRC32C that follows every block
+	// and the block handles in the footer.
+	sstChecksumSize = 4
+)
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// sstFooterSize returns the size of the footer for a format version: the
+// offset and length of the filter block from version 3 on, the offset and
+// length of the index block, their checksum from version 4 on, and the
+// trailer.
+func sstFooterSize(version uint32) (int, bool) {
+	switch version {
+	case 2:
+		return 16 + sstTrailerSize, true
+	case 3:
+		return 32 + sstTrailerSize, true
+	case 4, 5, 6:
+		return 32 + sstChecksumSize + sstTrailerSize, true
+	}
+	return 0, false
+}
+
+// CorruptionError reports an SST file whose contents are truncated or fail
+// checksum validation.
+type CorruptionError struct {
+	File   string
+	Offset int64
+	Reason string
+}
+
+func (e *CorruptionError) Error() string {
+	return fmt.Sprintf("corrupt SST file %s at offset %d: %s", e.File, e.Offset, e.Reason)
+}
+
+// blockHandle points at a data block and records the first key it holds.
+type blockHandle struct {
+	firstKey string
+	offset   uint64
+	length   uint64
+}
+
+// SSTFile is an open SST file. For block-based files only the index is kept
+// in memory and data blocks are read on demand. Files written before the
+// block format are loaded in full.
 type SSTFile struct {
-	file *os.File
+	file        *os.File
+	filename    string
+	version     uint32
+	index       []blockHandle
+	entryCount  uint64
+	smallestKey string
+	largestKey  string
+	filter      bloomFilter
+	legacy      []KeyValue
+	dataEnd     int64 // Start of the footer, no block extends past it
 }
 
-func createSSTFile(filename string) (*SSTFile, error) {
-	file, err := os.Create(filename)
+// openSSTFile opens an SST file and reads its footer and index block.
+func openSSTFile(filename string) (*SSTFile, error) {
+	file, err := os.Open(filename)
 	if err != nil {
 		return nil, err
 	}
-	return &SSTFile{file: file}, nil
+
+	s := &SSTFile{file: file, filename: filename}
+	if err := s.load(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *SSTFile) load() error {
+	info, err := s.file.Stat()
+	if err != nil {
+		return err
+	}
+	size := info.Size()
+
+	// Read and validate the magic number
+	if size < 8 {
+		return s.corruption(0, "file too short")
+	}
+	header := make([]byte, 8)
+	if _, err := s.file.ReadAt(header, 0); err != nil {
+		return err
+	}
+	magic := binary.LittleEndian.Uint64(header)
+
+	switch magic {
+	case magicNumber, typedMagicNumber:
+		data := make([]byte, size-8)
+		if _, err := s.file.ReadAt(data, 8); err != nil {
+			return err
+		}
+		r := bytes.NewReader(data)
+		keyValues, smallestKey, largestKey, err := parseLegacySSTFile(r, magic)
+		if err != nil {
+			return s.corruption(8+r.Size()-int64(r.Len()), err.Error())
+		}
+		s.legacy = keyValues
+		s.entryCount = uint64(len(keyValues))
+		s.smallestKey = smallestKey
+		s.largestKey = largestKey
+		return nil
+	case blockMagicNumber:
+	default:
+		return errors.New("Invalid SST file format")
+	}
+
+	// Read the footer trailer, it tells how large the rest of the footer is
+	if size < 8+sstTrailerSize {
+		return s.corruption(8, "file too short for footer")
+	}
+	trailer := make([]byte, sstTrailerSize)
+	if _, err := s.file.ReadAt(trailer, size-sstTrailerSize); err != nil {
+		return err
+	}
+	if binary.LittleEndian.Uint64(trailer[4:]) != blockMagicNumber {
+		return s.corruption(size-8, "bad footer magic number")
+	}
+	s.version = binary.LittleEndian.Uint32(trailer[0:])
+	footerSize, ok := sstFooterSize(s.version)
+	if !ok {
+		return s.corruption(size-sstTrailerSize, fmt.Sprintf("unsupported format version %d", s.version))
+	}
+	if size < int64(8+footerSize) {
+		return s.corruption(8, "file too short for footer")
+	}
+
+	// Read the block handles in the footer
+	footerOffset := size - int64(footerSize)
+	s.dataEnd = footerOffset
+	footer := make([]byte, footerSize-sstTrailerSize)
+	if _, err := s.file.ReadAt(footer, footerOffset); err != nil {
+		return err
+	}
+	if s.checksummed() {
+		handles := footer[:len(footer)-sstChecksumSize]
+		if crc32.Checksum(handles, crc32cTable) != binary.LittleEndian.Uint32(footer[len(handles):]) {
+			return s.corruption(footerOffset, "footer checksum mismatch")
+		}
+		footer = handles
+	}
+	if s.version >= 3 {
+		filterOffset := binary.LittleEndian.Uint64(footer[0:])
+		filterLength := binary.LittleEndian.Uint64(footer[8:])
+		footer = footer[16:]
+
+		// Read the filter block, it stays in memory while the file is open
+		if filterLength > 0 {
+			filter, err := s.readBlockData(filterOffset, filterLength, footerOffset)
+			if err != nil {
+				return err
+			}
+			s.filter = filter
+		}
+	}
+	indexOffset := binary.LittleEndian.Uint64(footer[0:])
+	indexLength := binary.LittleEndian.Uint64(footer[8:])
+
+	// Read the index block
+	data, err := s.readBlockData(indexOffset, indexLength, footerOffset)
+	if err != nil {
+		return err
+	}
+	r := bytes.NewReader(data)
+	if err := s.decodeIndex(r); err != nil {
+		return s.corruption(int64(indexOffset)+r.Size()-int64(r.Len()), "bad index block: "+err.Error())
+	}
+
+	// Every data block must lie before the footer
+	for _, handle := range s.index {
+		if !s.inBounds(handle.offset, handle.length, footerOffset) {
+			return s.corruption(int64(indexOffset), "index points outside the file")
+		}
+	}
+	return nil
+}
+
+func (s *SSTFile) decodeIndex(r *bytes.Reader) error {
+	var blockCount uint64
+	if err := binary.Read(r, binary.LittleEndian, &s.entryCount); err != nil {
+		return err
+	}
+
+	var err error
+	if s.smallestKey, err = readString(r); err != nil {
+		return err
+	}
+	if s.largestKey, err = readString(r); err != nil {
+		return err
+	}
+
+	if err := binary.Read(r, binary.LittleEndian, &blockCount); err != nil {
+		return err
+	}
+	if blockCount > uint64(r.Len()) {
+		return io.ErrUnexpectedEOF
+	}
+	s.index = make([]blockHandle, blockCount)
+	for i := range s.index {
+		if s.index[i].firstKey, err = readString(r); err != nil {
+			return err
+		}
+		if err := binary.Read(r, binary.LittleEndian, &s.index[i].offset); err != nil {
+			return err
+		}
+		if err := binary.Read(r, binary.LittleEndian, &s.index[i].length); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checksummed reports whether the blocks and footer of the file carry
+// checksums.
+func (s *SSTFile) checksummed() bool {
+	return s.version >= 4
+}
+
+// inBounds reports whether a block and its checksum end before limit.
+func (s *SSTFile) inBounds(offset, length uint64, limit int64) bool {
+	if s.checksummed() {
+		length += sstChecksumSize
+	}
+	return offset >= 8 && offset <= uint64(limit) && length <= uint64(limit)-offset
+}
+
+// readBlockData reads the block at offset and verifies its checksum. limit
+// is the start of the footer, no block may extend past it.
+func (s *SSTFile) readBlockData(offset, length uint64, limit int64) ([]byte, error) {
+	if !s.inBounds(offset, length, limit) {
+		return nil, s.corruption(int64(offset), "block extends past the end of the file")
+	}
+
+	size := length
+	if s.checksummed() {
+		size += sstChecksumSize
+	}
+	data := make([]byte, size)
+	if _, err := s.file.ReadAt(data, int64(offset)); err != nil {
+		if err == io.EOF {
+			return nil, s.corruption(int64(offset), "block truncated")
+		}
+		return nil, err
+	}
+
+	if s.checksummed() {
+		if crc32.Checksum(data[:length], crc32cTable) != binary.LittleEndian.Uint32(data[length:]) {
+			return nil, s.corruption(int64(offset), "block checksum mismatch")
+		}
+		data = data[:length]
+	}
+	return data, nil
+}
+
+func (s *SSTFile) corruption(offset int64, reason string) error {
+	return &CorruptionError{File: s.filename, Offset: offset, Reason: reason}
 }
 
 func (s *SSTFile) close() error {
 	return s.file.Close()
 }
 
+// mayContain checks the bloom filter of the file. A false result means the
+// file holds no entry for key. Files without a filter may contain any key.
+func (s *SSTFile) mayContain(key string) bool {
+	if s.filter == nil {
+		return true
+	}
+	return s.filter.mayContain(key)
+}
+
+// Get looks up the newest version of key numbered at most seq, reading at
+// most one data block. Tombstones are returned as found entries with Deleted
+// set. The bloom filter is not consulted, see mayContain.
+func (s *SSTFile) Get(key string, seq uint64) (KeyValue, bool, error) {
+	if s.entryCount == 0 || key < s.smallestKey || key > s.largestKey {
+		return KeyValue{}, false, nil
+	}
+
+	keyValues := s.legacy
+	if s.legacy == nil {
+		// The key can only be in the last block starting at or before it
+		i := sort.Search(len(s.index), func(i int) bool {
+			return s.index[i].firstKey > key
+		})
+		if i == 0 {
+			return KeyValue{}, false, nil
+		}
+
+		var err error
+		keyValues, err = s.readBlock(s.index[i-1])
+		if err != nil {
+			return KeyValue{}, false, err
+		}
+	}
+
+	// Entries are sorted by key, newest version first
+	i := sort.Search(len(keyValues), func(i int) bool {
+		return keyValues[i].Key > key || (keyValues[i].Key == key && keyValues[i].Seq <= seq)
+	})
+	if i < len(keyValues) && keyValues[i].Key == key {
+		return keyValues[i], true, nil
+	}
+	return KeyValue{}, false, nil
+}
+
+// entries returns every entry of the file in key order.
+func (s *SSTFile) entries() ([]KeyValue, error) {
+	if s.legacy != nil {
+		return s.legacy, nil
+	}
+
+	keyValues := make([]KeyValue, 0, s.entryCount)
+	for _, handle := range s.index {
+		block, err := s.readBlock(handle)
+		if err != nil {
+			return nil, err
+		}
+		keyValues = append(keyValues, block...)
+	}
+	return keyValues, nil
+}
+
+// tableIterator walks the entries of an SST file in key order, reading one
+// data block at a time.
+type tableIterator struct {
+	table *SSTFile
+	block []KeyValue
+	next  int // Index of the next block to read
+	pos   int
+}
+
+func (s *SSTFile) iterator() *tableIterator {
+	// Legacy files are already in memory, as a single block
+	return &tableIterator{table: s, block: s.legacy}
+}
+
+// Next returns the next entry, or false once the file is exhausted.
+func (it *tableIterator) Next() (KeyValue, bool, error) {
+	for it.pos >= len(it.block) {
+		if it.next >= len(it.table.index) {
+			return KeyValue{}, false, nil
+		}
+		block, err := it.table.readBlock(it.table.index[it.next])
+		if err != nil {
+			return KeyValue{}, false, err
+		}
+		it.block, it.pos = block, 0
+		it.next++
+	}
+	kv := it.block[it.pos]
+	it.pos++
+	return kv, true, nil
+}
+
+func (s *SSTFile) readBlock(handle blockHandle) ([]KeyValue, error) {
+	data, err := s.readBlockData(handle.offset, handle.length, s.dataEnd)
+	if err != nil {
+		return nil, err
+	}
+
+	r := bytes.NewReader(data)
+	var keyValues []KeyValue
+	for r.Len() > 0 {
+		kv, err := readEntry(r, true, s.version >= 5)
+		if err != nil {
+			return nil, s.corruption(int64(handle.offset)+r.Size()-int64(r.Len()), "bad entry: "+err.Error())
+		}
+		keyValues = append(keyValues, kv)
+	}
+	return keyValues, nil
+}
+
 func parseSSTFile(filename string) ([]KeyValue, string, string, error) {
-	file, err := os.Open(filename)
+	s, err := openSSTFile(filename)
 	if err != nil {
 		return nil, "", "", err
 	}
-	defer file.Close()
+	defer s.close()
 
-	// Read and validate the magic number
-	var magic uint64
-	if err := binary.Read(file, binary.LittleEndian, &magic); err != nil {
+	keyValues, err := s.entries()
+	if err != nil {
 		return nil, "", "", err
 	}
-	if magic != magicNumber {
-		return nil, "", "", errors.New("Invalid SST file format")
-	}
+	return keyValues, s.smallestKey, s.largestKey, nil
+}
 
+// parseLegacySSTFile reads the body of an SST file written before the block
+// format, right after its magic number. These files carry no checksums.
+func parseLegacySSTFile(r *bytes.Reader, magic uint64) ([]KeyValue, string, string, error) {
 	// Read entry count
 	var entryCount uint64
-	if err := binary.Read(file, binary.LittleEndian, &entryCount); err != nil {
+	if err := binary.Read(r, binary.LittleEndian, &entryCount); err != nil {
 		return nil, "", "", err
 	}
+	if entryCount == 0 {
+		return []KeyValue{}, "", "", nil
+	}
+	if entryCount > uint64(r.Len()) {
+		return nil, "", "", io.ErrUnexpectedEOF
+	}
 
 	// Read smallest key
-	smallestKey, err := readString(file)
+	smallestKey, err := readString(r)
 	if err != nil {
 		return nil, "", "", err
 	}
 
 	// Read largest key
-	largestKey, err := readString(file)
+	largestKey, err := readString(r)
 	if err != nil {
 		return nil, "", "", err
 	}
@@ -65,74 +465,284 @@ func parseSSTFile(filename string) ([]KeyValue, string, string, error) {
 	// Read key-value pairs
 	keyValues := make([]KeyValue, entryCount)
 	for i := uint64(0); i < entryCount; i++ {
-		key, err := readString(file)
+		keyValues[i], err = readEntry(r, magic == typedMagicNumber, false)
 		if err != nil {
 			return nil, "", "", err
 		}
+	}
 
-		value, err := readString(file)
-		if err != nil {
-			return nil, "", "", err
+	return keyValues, smallestKey, largestKey, nil
+}
+
+// readEntry reads a key, its kind and sequence number when the format has
+// them, the expiry time of an expiring value, and its value. Entries without
+// a sequence number are numbered 0, as older than any write since.
+func readEntry(r *bytes.Reader, typed, sequenced bool) (KeyValue, error) {
+	key, err := readString(r)
+	if err != nil {
+		return KeyValue{}, err
+	}
+
+	// Read the entry kind, older files only hold live values
+	kind := entryValue
+	if typed {
+		if err := binary.Read(r, binary.LittleEndian, &kind); err != nil {
+			return KeyValue{}, err
 		}
+	}
+
+	var seq uint64
+	if sequenced {
+		if err := binary.Read(r, binary.LittleEndian, &seq); err != nil {
+			return KeyValue{}, err
+		}
+	}
 
-		keyValues[i] = KeyValue{Key: key, Value: value}
+	var expiresAt int64
+	if kind == entryExpiring {
+		if err := binary.Read(r, binary.LittleEndian, &expiresAt); err != nil {
+			return KeyValue{}, err
+		}
 	}
 
-	// TODO: Implement checksum validation
+	value, err := readString(r)
+	if err != nil {
+		return KeyValue{}, err
+	}
 
-	return keyValues, smallestKey, largestKey, nil
+	return KeyValue{Key: key, Value: value, Deleted: kind == entryTombstone, Seq: seq, ExpiresAt: expiresAt}, nil
 }
 
-func flushSSTFile(filename string, keyValues []KeyValue) error {
-	file, err := os.Create(filename)
-	if err != nil {
+func writeEntry(w io.Writer, kv KeyValue) error {
+	if err := writeString(w, kv.Key); err != nil {
 		return err
 	}
-	defer file.Close()
-
-	// Write magic number
-	if err := binary.Write(file, binary.LittleEndian, magicNumber); err != nil {
+	kind := entryValue
+	if kv.Deleted {
+		kind = entryTombstone
+	} else if kv.ExpiresAt != 0 {
+		kind = entryExpiring
+	}
+	if err := binary.Write(w, binary.LittleEndian, kind); err != nil {
 		return err
 	}
-
-	// Write entry count
-	entryCount := uint64(len(keyValues))
-	if err := binary.Write(file, binary.LittleEndian, entryCount); err != nil {
+	if err := binary.Write(w, binary.LittleEndian, kv.Seq); err != nil {
 		return err
 	}
-
-	// Sort keyValues by key
-	sort.Slice(keyValues, func(i, j int) bool {
-		return keyValues[i].Key < keyValues[j].Key
-	})
-
-	// Write smallest key
-	if len(keyValues) > 0 {
-		if err := writeString(file, keyValues[0].Key); err != nil {
+	if kind == entryExpiring {
+		if err := binary.Write(w, binary.LittleEndian, kv.ExpiresAt); err != nil {
 			return err
 		}
 	}
+	return writeString(w, kv.Value)
+}
+
+// sstWriter writes sorted entries as a block-based SST file: a header, data
+// blocks of about sstBlockSize bytes, a bloom filter block over every key,
+// an index block holding the first key and position of every data block,
+// and a footer. Every block and the footer end with a CRC32C checksum. The
+// versions of a key are kept in a single block, so a lookup still reads one.
+type sstWriter struct {
+	w           *bufio.Writer
+	bitsPerKey  int
+	keys        []string
+	offset      uint64
+	block       bytes.Buffer
+	index       []blockHandle
+	entryCount  uint64
+	smallestKey string
+	largestKey  string
+}
+
+// newSSTWriter starts an SST file on w. A bitsPerKey of zero or less skips
+// the bloom filter.
+func newSSTWriter(w io.Writer, bitsPerKey int) (*sstWriter, error) {
+	sw := &sstWriter{w: bufio.NewWriter(w), bitsPerKey: bitsPerKey}
+
+	// Write magic number
+	if err := binary.Write(sw.w, binary.LittleEndian, blockMagicNumber); err != nil {
+		return nil, err
+	}
+	sw.offset = 8
+	return sw, nil
+}
+
+// add appends an entry. Entries must be added in the order of lessKeyValue.
+func (sw *sstWriter) add(kv KeyValue) error {
+	newKey := sw.entryCount == 0 || kv.Key != sw.largestKey
+	if sw.entryCount == 0 {
+		sw.smallestKey = kv.Key
+	}
+	sw.largestKey = kv.Key
+	sw.entryCount++
+	if sw.bitsPerKey > 0 && newKey {
+		sw.keys = append(sw.keys, kv.Key)
+	}
 
-	// Write largest key
-	if len(keyValues) > 0 {
-		if err := writeString(file, keyValues[len(keyValues)-1].Key); err != nil {
+	// A full block is only ended between two keys
+	if newKey && sw.block.Len() >= sstBlockSize {
+		if err := sw.finishBlock(); err != nil {
 			return err
 		}
 	}
+	if sw.block.Len() == 0 {
+		sw.index = append(sw.index, blockHandle{firstKey: kv.Key, offset: sw.offset})
+	}
+	return writeEntry(&sw.block, kv)
+}
+
+// size returns the number of bytes written so far, including the pending
+// data block.
+func (sw *sstWriter) size() uint64 {
+	return sw.offset + uint64(sw.block.Len())
+}
+
+func (sw *sstWriter) finishBlock() error {
+	if sw.block.Len() == 0 {
+		return nil
+	}
+	sw.index[len(sw.index)-1].length = uint64(sw.block.Len())
+	if _, err := sw.writeBlock(sw.block.Bytes()); err != nil {
+		return err
+	}
+	sw.block.Reset()
+	return nil
+}
 
-	// Write key-value pairs
-	for _, kv := range keyValues {
-		if err := writeString(file, kv.Key); err != nil {
+// writeBlock writes data followed by its checksum and returns its offset.
+func (sw *sstWriter) writeBlock(data []byte) (uint64, error) {
+	offset := sw.offset
+	if _, err := sw.w.Write(data); err != nil {
+		return 0, err
+	}
+	if err := binary.Write(sw.w, binary.LittleEndian, crc32.Checksum(data, crc32cTable)); err != nil {
+		return 0, err
+	}
+	sw.offset += uint64(len(data)) + sstChecksumSize
+	return offset, nil
+}
+
+// finish writes the last data block, the filter block, the index block and
+// the footer.
+func (sw *sstWriter) finish() error {
+	if err := sw.finishBlock(); err != nil {
+		return err
+	}
+
+	// Write the filter block
+	var filterOffset, filterLength uint64
+	if sw.bitsPerKey > 0 {
+		filter := newBloomFilter(sw.keys, sw.bitsPerKey)
+		offset, err := sw.writeBlock(filter)
+		if err != nil {
 			return err
 		}
-		if err := writeString(file, kv.Value); err != nil {
-			return err
+		filterOffset, filterLength = offset, uint64(len(filter))
+	}
+
+	// Write the index block
+	var index bytes.Buffer
+	binary.Write(&index, binary.LittleEndian, sw.entryCount)
+	writeString(&index, sw.smallestKey)
+	writeString(&index, sw.largestKey)
+	binary.Write(&index, binary.LittleEndian, uint64(len(sw.index)))
+	for _, handle := range sw.index {
+		writeString(&index, handle.firstKey)
+		binary.Write(&index, binary.LittleEndian, handle.offset)
+		binary.Write(&index, binary.LittleEndian, handle.length)
+	}
+	indexOffset, err := sw.writeBlock(index.Bytes())
+	if err != nil {
+		return err
+	}
+
+	// Write the footer, its checksum covers the block handles
+	footerSize, _ := sstFooterSize(sstFormatVersion)
+	footer := make([]byte, footerSize)
+	binary.LittleEndian.PutUint64(footer[0:], filterOffset)
+	binary.LittleEndian.PutUint64(footer[8:], filterLength)
+	binary.LittleEndian.PutUint64(footer[16:], indexOffset)
+	binary.LittleEndian.PutUint64(footer[24:], uint64(index.Len()))
+	binary.LittleEndian.PutUint32(footer[32:], crc32.Checksum(footer[:32], crc32cTable))
+	binary.LittleEndian.PutUint32(footer[36:], sstFormatVersion)
+	binary.LittleEndian.PutUint64(footer[40:], blockMagicNumber)
+	if _, err := sw.w.Write(footer); err != nil {
+		return err
+	}
+
+	return sw.w.Flush()
+}
+
+// flushSSTFile writes keyValues to a new SST file. The file only appears
+// under filename once it is complete and on disk, see createSSTFile.
+func flushSSTFile(filename string, keyValues []KeyValue, bitsPerKey int) error {
+	file, err := createSSTFile(filename)
+	if err != nil {
+		return err
+	}
+
+	// Sort keyValues by key, newest version first
+	sort.Slice(keyValues, func(i, j int) bool {
+		return lessKeyValue(keyValues[i], keyValues[j])
+	})
+
+	sw, err := newSSTWriter(file, bitsPerKey)
+	if err == nil {
+		for _, kv := range keyValues {
+			if err = sw.add(kv); err != nil {
+				break
+			}
 		}
 	}
+	if err == nil {
+		err = sw.finish()
+	}
+	if err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return err
+	}
+	return commitSSTFile(file, filename)
+}
 
-	// TODO: Calculate and write checksum
+// sstTempSuffix marks SST files that are still being written. A crash can
+// leave them behind, and they are removed when the store is opened.
+const sstTempSuffix = ".tmp"
 
-	return nil
+// createSSTFile creates the temporary file an SST file is written to before
+// commitSSTFile moves it to filename.
+func createSSTFile(filename string) (*os.File, error) {
+	return os.OpenFile(filename+sstTempSuffix, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+}
+
+// commitSSTFile fsyncs and closes a complete SST file from createSSTFile,
+// renames it to filename and fsyncs the directory, so the file is either
+// missing or complete after a crash.
+func commitSSTFile(file *os.File, filename string) error {
+	if err := file.Sync(); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return err
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(file.Name())
+		return err
+	}
+	if err := os.Rename(file.Name(), filename); err != nil {
+		os.Remove(file.Name())
+		return err
+	}
+	return syncDir(filepath.Dir(filename))
+}
+
+// syncDir fsyncs a directory, making the renames in it durable.
+func syncDir(dir string) error {
+	file, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return file.Sync()
 }
 
 func writeString(w io.Writer, s string) error {
@@ -145,12 +755,15 @@ func writeString(w io.Writer, s string) error {
 	return err
 }
 
-func readString(r io.Reader) (string, error) {
+func readString(r *bytes.Reader) (string, error) {
 	// Read string length
 	var length uint64
 	if err := binary.Read(r, binary.LittleEndian, &length); err != nil {
 		return "", err
 	}
+	if length > uint64(r.Len()) {
+		return "", io.ErrUnexpectedEOF
+	}
 	// Read string data
 	data := make([]byte, length)
 	_, err := io.ReadFull(r, data)
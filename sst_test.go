@@ -0,0 +1,278 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSSTFileBlocks(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "blocks.sst")
+
+	var keyValues []KeyValue
+	for i := 0; i < 1000; i++ {
+		keyValues = append(keyValues, KeyValue{Key: fmt.Sprintf("key%04d", i), Value: fmt.Sprintf("value%d", i), Deleted: i%10 == 0})
+	}
+	if err := flushSSTFile(filename, keyValues, defaultBloomBitsPerKey); err != nil {
+		t.Fatalf("Error flushing SST file: %v", err)
+	}
+
+	s, err := openSSTFile(filename)
+	if err != nil {
+		t.Fatalf("Error opening SST file: %v", err)
+	}
+	defer s.close()
+
+	if len(s.index) < 2 {
+		t.Fatalf("Expected several data blocks, got %d", len(s.index))
+	}
+	if s.smallestKey != "key0000" || s.largestKey != "key0999" {
+		t.Errorf("Expected key range key0000..key0999, got %s..%s", s.smallestKey, s.largestKey)
+	}
+
+	for _, kv := range keyValues {
+		got, found, err := s.Get(kv.Key, math.MaxUint64)
+		if err != nil {
+			t.Fatalf("Error looking up %s: %v", kv.Key, err)
+		}
+		if !found || got != kv {
+			t.Fatalf("Expected %+v, got %+v (found %v)", kv, got, found)
+		}
+	}
+	for _, key := range []string{"a", "key0000a", "key1000", "z"} {
+		if _, found, _ := s.Get(key, math.MaxUint64); found {
+			t.Errorf("Expected %s to be missing", key)
+		}
+	}
+
+	all, err := s.entries()
+	if err != nil {
+		t.Fatalf("Error reading entries: %v", err)
+	}
+	if len(all) != len(keyValues) {
+		t.Errorf("Expected %d entries, got %d", len(keyValues), len(all))
+	}
+}
+
+func TestSSTFileVersions(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "versions.sst")
+
+	// Enough versions per key to fill several blocks
+	var keyValues []KeyValue
+	value := strings.Repeat("v", 200)
+	for i := 0; i < 20; i++ {
+		for seq := uint64(1); seq <= 10; seq++ {
+			keyValues = append(keyValues, KeyValue{Key: fmt.Sprintf("key%02d", i), Value: value + fmt.Sprint(seq), Seq: seq*100 + uint64(i)})
+		}
+	}
+	if err := flushSSTFile(filename, keyValues, defaultBloomBitsPerKey); err != nil {
+		t.Fatalf("Error flushing SST file: %v", err)
+	}
+
+	s, err := openSSTFile(filename)
+	if err != nil {
+		t.Fatalf("Error opening SST file: %v", err)
+	}
+	defer s.close()
+
+	// Every block starts with the newest version of a key
+	for _, handle := range s.index {
+		block, err := s.readBlock(handle)
+		if err != nil {
+			t.Fatalf("Error reading block: %v", err)
+		}
+		if block[0].Key != handle.firstKey || !strings.HasSuffix(block[0].Value, "10") {
+			t.Errorf("Expected block to start with the newest version of %s, got %+v", handle.firstKey, block[0])
+		}
+	}
+
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("key%02d", i)
+		if got, found, err := s.Get(key, 550); err != nil || !found || got.Seq != 500+uint64(i) {
+			t.Errorf("Expected version %d of %s, got %+v (found %v, %v)", 500+i, key, got, found, err)
+		}
+		if _, found, _ := s.Get(key, 50); found {
+			t.Errorf("Expected no version of %s before it was written", key)
+		}
+	}
+}
+
+func TestSSTFileExpiringEntries(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "expiring.sst")
+	keyValues := []KeyValue{
+		{Key: "a", Value: "plain", Seq: 1},
+		{Key: "b", Value: "session", Seq: 3, ExpiresAt: 1234567890},
+		{Key: "b", Value: "older", Seq: 2},
+		{Key: "c", Deleted: true, Seq: 4},
+	}
+	if err := flushSSTFile(filename, keyValues, defaultBloomBitsPerKey); err != nil {
+		t.Fatalf("Error flushing SST file: %v", err)
+	}
+
+	s, err := openSSTFile(filename)
+	if err != nil {
+		t.Fatalf("Error opening SST file: %v", err)
+	}
+	defer s.close()
+	entries, err := s.entries()
+	if err != nil {
+		t.Fatalf("Error reading SST file: %v", err)
+	}
+	if !reflect.DeepEqual(entries, keyValues) {
+		t.Errorf("Expected %+v, got %+v", keyValues, entries)
+	}
+}
+
+func TestSSTFileLegacyFormat(t *testing.T) {
+	// mohieddine_1.sst was written with the original format
+	keyValues, smallestKey, largestKey, err := parseSSTFile("mohieddine_1.sst")
+	if err != nil {
+		t.Fatalf("Error parsing legacy SST file: %v", err)
+	}
+	if len(keyValues) != 4 || smallestKey != "1" || largestKey != "4" {
+		t.Fatalf("Unexpected legacy contents %v (%s..%s)", keyValues, smallestKey, largestKey)
+	}
+
+	s, err := openSSTFile("mohieddine_1.sst")
+	if err != nil {
+		t.Fatalf("Error opening legacy SST file: %v", err)
+	}
+	defer s.close()
+	kv, found, err := s.Get("3", math.MaxUint64)
+	if err != nil || !found || kv.Value != "value3" {
+		t.Errorf("Expected value3 for key 3, got %+v (found %v, err %v)", kv, found, err)
+	}
+}
+
+func TestBloomFilter(t *testing.T) {
+	var keys []string
+	for i := 0; i < 1000; i++ {
+		keys = append(keys, fmt.Sprintf("key%d", i))
+	}
+	filter := newBloomFilter(keys, defaultBloomBitsPerKey)
+
+	for _, key := range keys {
+		if !filter.mayContain(key) {
+			t.Fatalf("Expected filter to contain %s", key)
+		}
+	}
+
+	falsePositives := 0
+	for i := 0; i < 10000; i++ {
+		if filter.mayContain(fmt.Sprintf("missing%d", i)) {
+			falsePositives++
+		}
+	}
+	if falsePositives > 300 {
+		t.Errorf("Expected about 1%% false positives, got %d in 10000", falsePositives)
+	}
+}
+
+func TestSSTFileCorruption(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "corrupt.sst")
+
+	var keyValues []KeyValue
+	for i := 0; i < 1000; i++ {
+		keyValues = append(keyValues, KeyValue{Key: fmt.Sprintf("key%04d", i), Value: fmt.Sprintf("value%d", i)})
+	}
+	if err := flushSSTFile(filename, keyValues, defaultBloomBitsPerKey); err != nil {
+		t.Fatalf("Error flushing SST file: %v", err)
+	}
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatalf("Error reading SST file: %v", err)
+	}
+
+	s, err := openSSTFile(filename)
+	if err != nil {
+		t.Fatalf("Error opening SST file: %v", err)
+	}
+	block := s.index[1]
+	s.close()
+
+	// Flip a bit inside the second data block
+	flipped := append([]byte(nil), data...)
+	flipped[block.offset+10] ^= 0x01
+	if err := os.WriteFile(filename, flipped, 0644); err != nil {
+		t.Fatalf("Error writing SST file: %v", err)
+	}
+	s, err = openSSTFile(filename)
+	if err != nil {
+		t.Fatalf("Error opening SST file with a corrupt data block: %v", err)
+	}
+	_, _, err = s.Get(block.firstKey, math.MaxUint64)
+	s.close()
+	var corruption *CorruptionError
+	if !errors.As(err, &corruption) {
+		t.Fatalf("Expected CorruptionError, got %v", err)
+	}
+	if corruption.File != filename || corruption.Offset != int64(block.offset) {
+		t.Errorf("Expected corruption in %s at %d, got %v", filename, block.offset, corruption)
+	}
+
+	// Flip a bit in the footer block handles
+	flipped = append([]byte(nil), data...)
+	flipped[len(flipped)-30] ^= 0x01
+	if err := os.WriteFile(filename, flipped, 0644); err != nil {
+		t.Fatalf("Error writing SST file: %v", err)
+	}
+	if _, err := openSSTFile(filename); !errors.As(err, &corruption) {
+		t.Errorf("Expected CorruptionError for a corrupt footer, got %v", err)
+	}
+
+	// Truncate the file
+	for _, size := range []int{len(data) - 1, len(data) / 2, 12} {
+		if err := os.WriteFile(filename, data[:size], 0644); err != nil {
+			t.Fatalf("Error writing SST file: %v", err)
+		}
+		if _, err := openSSTFile(filename); !errors.As(err, &corruption) {
+			t.Errorf("Expected CorruptionError for a file truncated to %d bytes, got %v", size, err)
+		}
+	}
+}
+
+func TestFlushSSTFileIsAtomic(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "atomic.sst")
+	if err := flushSSTFile(filename, []KeyValue{{Key: "key", Value: "value"}}, defaultBloomBitsPerKey); err != nil {
+		t.Fatalf("Error flushing SST file: %v", err)
+	}
+	if _, err := os.Stat(filename + sstTempSuffix); !os.IsNotExist(err) {
+		t.Errorf("Expected the temporary file to be renamed, got %v", err)
+	}
+	s, err := openSSTFile(filename)
+	if err != nil {
+		t.Fatalf("Error opening SST file: %v", err)
+	}
+	kv, found, err := s.Get("key", math.MaxUint64)
+	s.close()
+	if err != nil || !found || kv.Value != "value" {
+		t.Errorf("Expected value for key, got %+v, %v (%v)", kv, found, err)
+	}
+
+	// A half-written file left by a crash is removed when the store opens
+	opts := testOptions()
+	names := opts.fileNames()
+	names.dir = dir
+	temp := names.sst(7) + sstTempSuffix
+	if err := os.WriteFile(temp, []byte("partial"), 0644); err != nil {
+		t.Fatalf("Error writing temporary file: %v", err)
+	}
+	memDB, err := Open(dir, opts)
+	if err != nil {
+		t.Fatalf("Error opening MemDB: %v", err)
+	}
+	defer memDB.Close()
+	if _, err := os.Stat(temp); !os.IsNotExist(err) {
+		t.Errorf("Expected the orphaned temporary file to be removed, got %v", err)
+	}
+	if files := memDB.manifest.Files(); len(files) != 0 {
+		t.Errorf("Expected no live SST files, got %+v", files)
+	}
+}
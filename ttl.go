@@ -0,0 +1,75 @@
+package main
+
+import (
+	"math"
+	"sync/atomic"
+	"time"
+)
+
+// A value set with a TTL carries its expiry time through the WAL, the
+// memtable and the SST files. Readers treat an expired value as deleted, so
+// it keeps hiding the older values of its key. Flushes and compactions write
+// it out as a tombstone, which they drop as usual once no older file holds
+// the key. Until the memtable is flushed, the sweeper below frees the memory
+// of its expired values.
+
+// expiryAfter returns the expiry time of a value written at from with ttl,
+// in Unix nanoseconds. ok is false if that is past what an int64 holds, in
+// the year 2262.
+func expiryAfter(from time.Time, ttl time.Duration) (expiresAt int64, ok bool) {
+	start := from.UnixNano()
+	if ttl > time.Duration(math.MaxInt64-start) {
+		return 0, false
+	}
+	return start + int64(ttl), true
+}
+
+// backgroundSweep sweeps the memtable every TTLSweepInterval until the store
+// is closed.
+func (mem *MemDB) backgroundSweep() {
+	defer close(mem.sweepDone)
+	ticker := time.NewTicker(mem.opts.TTLSweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-mem.stopSweep:
+			return
+		case <-ticker.C:
+			mem.sweepExpired()
+		}
+	}
+}
+
+// sweepExpired replaces the expired values of the memtable by tombstones
+// under the same sequence numbers, which every reader already sees them as,
+// and returns how many it replaced. Nothing is written to the WAL: replaying
+// the original records gives values that have expired as well.
+func (mem *MemDB) sweepExpired() int {
+	// Look for expired values without holding up writers
+	mem.mu.RLock()
+	memtable := mem.memtable
+	mem.mu.RUnlock()
+	now := time.Now().UnixNano()
+	var expired []KeyValue
+	for _, kv := range memtable.GetKeyValues() {
+		if kv.expired(now) {
+			expired = append(expired, kv)
+		}
+	}
+	if len(expired) == 0 {
+		return 0
+	}
+
+	// The sweeper is a writer of the memtable, unless it has been rotated
+	// in the meantime
+	mem.writeMu.Lock()
+	defer mem.writeMu.Unlock()
+	if mem.memtable != memtable {
+		return 0
+	}
+	for _, kv := range expired {
+		memtable.Set(kv.Key, "", false, kv.Seq, 0)
+	}
+	atomic.AddUint64(&mem.expiredSwept, uint64(len(expired)))
+	return len(expired)
+}
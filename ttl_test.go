@@ -0,0 +1,204 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// openTTLTestDB opens a store whose sweeper only runs when a test calls it.
+func openTTLTestDB(t *testing.T, dir string) *MemDB {
+	t.Helper()
+	opts := testOptions()
+	opts.TTLSweepInterval = -1
+	memDB, err := Open(dir, opts)
+	if err != nil {
+		t.Fatalf("Error opening MemDB: %v", err)
+	}
+	return memDB
+}
+
+func TestSetWithTTLExpires(t *testing.T) {
+	memDB := openTTLTestDB(t, t.TempDir())
+	defer memDB.Close()
+
+	if err := memDB.Set("session", "old"); err != nil {
+		t.Fatalf("Error setting key-value pair: %v", err)
+	}
+	if err := memDB.SetWithTTL("session", "new", 50*time.Millisecond); err != nil {
+		t.Fatalf("Error setting key-value pair with TTL: %v", err)
+	}
+	if err := memDB.SetWithTTL("session", "value", 0); err == nil {
+		t.Error("Expected an error for a TTL of 0")
+	}
+
+	entry, err := memDB.GetEntry("session")
+	if err != nil || entry.Value != "new" {
+		t.Fatalf("Expected new before expiry, got %q (%v)", entry.Value, err)
+	}
+	if remaining := time.Until(time.Unix(0, entry.ExpiresAt)); remaining <= 0 || remaining > 50*time.Millisecond {
+		t.Errorf("Expected the value to expire within 50ms, got %v", remaining)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+
+	// The expired value hides the older one, as a delete would
+	if value, err := memDB.Get("session"); err == nil {
+		t.Errorf("Expected the expired key to be missing, got %q", value)
+	}
+	it := memDB.NewIterator(IteratorOptions{})
+	it.SeekToFirst()
+	if it.Valid() {
+		t.Errorf("Expected the iterator to skip the expired key, got %s", it.Key())
+	}
+	it.Close()
+	if ok, err := memDB.SetIfAbsent("session", "again"); err != nil || !ok {
+		t.Errorf("Expected SetIfAbsent of an expired key to succeed, got %v (%v)", ok, err)
+	}
+	if value, err := memDB.Get("session"); err != nil || value != "again" {
+		t.Errorf("Expected again, got %q (%v)", value, err)
+	}
+}
+
+func TestSetWithTTLPastInt64(t *testing.T) {
+	memDB := openTTLTestDB(t, t.TempDir())
+	defer memDB.Close()
+
+	// An expiry past 2262 does not fit in int64 nanoseconds
+	const ttl = 9000000000 * time.Second
+	if err := memDB.SetWithTTL("key", "value", ttl); err == nil {
+		t.Error("Expected an error for a TTL past the year 2262")
+	}
+	if _, err := memDB.Get("key"); err == nil {
+		t.Error("Expected nothing to be written for a TTL that is too long")
+	}
+
+	// A batch keeps the value until the latest expiry it can hold
+	batch := NewWriteBatch()
+	batch.SetWithTTL("key", "value", ttl)
+	if err := memDB.Write(batch); err != nil {
+		t.Fatalf("Error writing batch: %v", err)
+	}
+	if value, err := memDB.Get("key"); err != nil || value != "value" {
+		t.Errorf("Expected value for a batch with a long TTL, got %q (%v)", value, err)
+	}
+}
+
+func TestTTLSurvivesRestartAndFlush(t *testing.T) {
+	dir := t.TempDir()
+	memDB := openTTLTestDB(t, dir)
+
+	if err := memDB.SetWithTTL("long", "value", time.Hour); err != nil {
+		t.Fatalf("Error setting key-value pair with TTL: %v", err)
+	}
+	if err := memDB.SetWithTTL("short", "value", 100*time.Millisecond); err != nil {
+		t.Fatalf("Error setting key-value pair with TTL: %v", err)
+	}
+	before, err := memDB.GetEntry("long")
+	if err != nil {
+		t.Fatalf("Error getting key: %v", err)
+	}
+	memDB.Close()
+
+	// The expiry times come back from the WAL, then from the SST file
+	memDB = openTTLTestDB(t, dir)
+	defer memDB.Close()
+	for _, flush := range []bool{false, true} {
+		if flush {
+			if err := memDB.Flush(); err != nil {
+				t.Fatalf("Error flushing memtable: %v", err)
+			}
+		}
+		if entry, err := memDB.GetEntry("long"); err != nil || entry.ExpiresAt != before.ExpiresAt {
+			t.Errorf("Expected the expiry time %d after flush=%v, got %d (%v)", before.ExpiresAt, flush, entry.ExpiresAt, err)
+		}
+	}
+
+	time.Sleep(110 * time.Millisecond)
+	if _, err := memDB.Get("short"); err == nil {
+		t.Error("Expected the short-lived key to have expired in the SST file")
+	}
+	if _, err := memDB.Get("long"); err != nil {
+		t.Errorf("Expected the long-lived key to be there, got %v", err)
+	}
+}
+
+func TestCompactionDropsExpiredValues(t *testing.T) {
+	memDB := openCompactionTestDB(t, t.TempDir())
+	defer memDB.Close()
+
+	// Flush the expiring keys into level 0, under more keys
+	for i := 0; i <= threshold; i++ {
+		if err := memDB.SetWithTTL("session"+strconv.Itoa(i), "value", 50*time.Millisecond); err != nil {
+			t.Fatalf("Error setting key-value pair with TTL: %v", err)
+		}
+	}
+	if err := memDB.waitForFlushes(); err != nil {
+		t.Fatalf("Error flushing memtable: %v", err)
+	}
+	time.Sleep(60 * time.Millisecond)
+	for i := 0; i < 2*threshold; i++ {
+		if err := memDB.Set("other"+strconv.Itoa(i), "value"); err != nil {
+			t.Fatalf("Error setting key-value pair: %v", err)
+		}
+	}
+	if err := memDB.waitForFlushes(); err != nil {
+		t.Fatalf("Error flushing memtable: %v", err)
+	}
+	if err := memDB.compact(); err != nil {
+		t.Fatalf("Error compacting: %v", err)
+	}
+
+	// Nothing older holds the keys, so neither value nor tombstone is kept
+	for _, meta := range memDB.manifest.Files() {
+		if meta.Level == 0 {
+			t.Fatalf("Expected level 0 to be empty, got %+v", meta)
+		}
+		keyValues, _, _, err := parseSSTFile(memDB.names.sst(meta.Number))
+		if err != nil {
+			t.Fatalf("Error parsing SST file: %v", err)
+		}
+		for _, kv := range keyValues {
+			if strings.HasPrefix(kv.Key, "session") {
+				t.Errorf("Expected %s to be dropped by compaction, got %+v", kv.Key, kv)
+			}
+		}
+	}
+}
+
+func TestSweeperReplacesExpiredValues(t *testing.T) {
+	memDB := openTTLTestDB(t, t.TempDir())
+	defer memDB.Close()
+
+	if err := memDB.Set("key", "old"); err != nil {
+		t.Fatalf("Error setting key-value pair: %v", err)
+	}
+	if err := memDB.SetWithTTL("key", "expiring", 20*time.Millisecond); err != nil {
+		t.Fatalf("Error setting key-value pair with TTL: %v", err)
+	}
+	if err := memDB.SetWithTTL("other", "lasting", time.Hour); err != nil {
+		t.Fatalf("Error setting key-value pair with TTL: %v", err)
+	}
+	if swept := memDB.sweepExpired(); swept != 0 {
+		t.Errorf("Expected nothing to sweep yet, swept %d", swept)
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	size := memDB.Stats().MemtableSize
+	if swept := memDB.sweepExpired(); swept != 1 {
+		t.Errorf("Expected to sweep 1 value, swept %d", swept)
+	}
+	stats := memDB.Stats()
+	if stats.ExpiredSwept != 1 || stats.MemtableSize != size-int64(len("expiring")) {
+		t.Errorf("Expected the expired value to be freed, got %+v (size was %d)", stats, size)
+	}
+
+	// The tombstone hides the older value, and the other key is untouched
+	if value, err := memDB.Get("key"); err == nil {
+		t.Errorf("Expected the swept key to be missing, got %q", value)
+	}
+	if value, err := memDB.Get("other"); err != nil || value != "lasting" {
+		t.Errorf("Expected lasting for other, got %q (%v)", value, err)
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"errors"
+	"math"
+)
+
+// ErrConflict is returned by Txn.Commit when a key the transaction read was
+// written by someone else after the transaction began.
+var ErrConflict = errors.New("Transaction conflict")
+
+// Txn is an optimistic transaction. Its reads come from a snapshot taken by
+// Begin and its writes are buffered until Commit, which applies them
+// atomically unless a key that was read has changed since the snapshot.
+// Keys that were only written are not checked. A Txn is not safe for
+// concurrent use.
+type Txn struct {
+	mem     *MemDB
+	snap    *Snapshot
+	reads   map[string]bool
+	writes  *WriteBatch
+	written map[string]*string // Buffered values, nil for a delete
+	done    bool
+}
+
+// Begin starts a transaction. It must be ended by Commit or Rollback, since
+// its snapshot keeps old versions around.
+func (mem *MemDB) Begin() *Txn {
+	return &Txn{
+		mem:     mem,
+		snap:    mem.Snapshot(),
+		reads:   make(map[string]bool),
+		writes:  NewWriteBatch(),
+		written: make(map[string]*string),
+	}
+}
+
+// Get gets the value of key as written earlier in the transaction, or else
+// as of its snapshot.
+func (txn *Txn) Get(key string) (string, error) {
+	if txn.done {
+		return "", errors.New("Transaction already finished")
+	}
+	if value, ok := txn.written[key]; ok {
+		if value == nil {
+			return "", errors.New("Key not found")
+		}
+		return *value, nil
+	}
+	txn.reads[key] = true
+	return txn.snap.Get(key)
+}
+
+// Set buffers a write of value for key.
+func (txn *Txn) Set(key, value string) error {
+	if txn.done {
+		return errors.New("Transaction already finished")
+	}
+	txn.writes.Set(key, value)
+	txn.written[key] = &value
+	return nil
+}
+
+// Del buffers a delete of key. Like WriteBatch.Del, it does not check that
+// the key exists.
+func (txn *Txn) Del(key string) error {
+	if txn.done {
+		return errors.New("Transaction already finished")
+	}
+	txn.writes.Del(key)
+	txn.written[key] = nil
+	return nil
+}
+
+// Commit applies the buffered writes, all or nothing. It returns
+// ErrConflict, and writes nothing, if a key read by the transaction has a
+// version newer than its snapshot. The transaction is finished either way.
+func (txn *Txn) Commit() error {
+	if txn.done {
+		return errors.New("Transaction already finished")
+	}
+	defer txn.finish()
+
+	mem := txn.mem
+	_, err := mem.writeIf(txn.writes, func() error {
+		// Writers are held off, so the newest versions cannot change
+		mem.mu.RLock()
+		defer mem.mu.RUnlock()
+		for key := range txn.reads {
+			latest, found, err := mem.lookup(key, math.MaxUint64)
+			if err != nil {
+				return err
+			}
+			if found && latest.Seq > txn.snap.Seq() {
+				return ErrConflict
+			}
+		}
+		return nil
+	})
+	return err
+}
+
+// Rollback drops the buffered writes. Rolling back a finished transaction
+// does nothing.
+func (txn *Txn) Rollback() {
+	if !txn.done {
+		txn.finish()
+	}
+}
+
+func (txn *Txn) finish() {
+	txn.done = true
+	txn.snap.Release()
+}
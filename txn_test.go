@@ -0,0 +1,152 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestTxnReadsSnapshotAndOwnWrites(t *testing.T) {
+	memDB := openTestDB(t, t.TempDir())
+	defer memDB.Close()
+
+	if err := memDB.Set("a", "1"); err != nil {
+		t.Fatalf("Error setting key-value pair: %v", err)
+	}
+	txn := memDB.Begin()
+	if err := memDB.Set("b", "2"); err != nil {
+		t.Fatalf("Error setting key-value pair: %v", err)
+	}
+	if _, err := txn.Get("b"); err == nil {
+		t.Error("Expected a write after Begin to be invisible to the transaction")
+	}
+	txn.Rollback()
+
+	txn = memDB.Begin()
+	txn.Set("c", "3")
+	txn.Del("a")
+	if value, err := txn.Get("c"); err != nil || value != "3" {
+		t.Errorf("Expected the transaction to read its own write, got %q (%v)", value, err)
+	}
+	if _, err := txn.Get("a"); err == nil {
+		t.Error("Expected the transaction to read its own delete")
+	}
+	if _, err := memDB.Get("c"); err == nil {
+		t.Error("Expected writes to be buffered until Commit")
+	}
+
+	if err := txn.Commit(); err != nil {
+		t.Fatalf("Error committing transaction: %v", err)
+	}
+	if value, err := memDB.Get("c"); err != nil || value != "3" {
+		t.Errorf("Expected 3 for c after Commit, got %q (%v)", value, err)
+	}
+	if _, err := memDB.Get("a"); err == nil {
+		t.Error("Expected a to be deleted after Commit")
+	}
+	if err := txn.Set("d", "4"); err == nil {
+		t.Error("Expected an error for a write after Commit")
+	}
+
+	txn = memDB.Begin()
+	txn.Set("e", "5")
+	txn.Rollback()
+	if _, err := memDB.Get("e"); err == nil {
+		t.Error("Expected Rollback to drop the writes")
+	}
+}
+
+func TestTxnConflicts(t *testing.T) {
+	memDB := openTestDB(t, t.TempDir())
+	defer memDB.Close()
+
+	for _, key := range []string{"read", "written"} {
+		if err := memDB.Set(key, "old"); err != nil {
+			t.Fatalf("Error setting key-value pair: %v", err)
+		}
+	}
+
+	tests := []struct {
+		name     string
+		other    func()
+		conflict bool
+	}{
+		{"set of a read key", func() { memDB.Set("read", "new") }, true},
+		{"delete of a read key", func() { memDB.Del("read") }, true},
+		{"creation of a key read as missing", func() { memDB.Set("missing", "new") }, true},
+		{"set of a key only written", func() { memDB.Set("written", "new") }, false},
+		{"flush", func() { memDB.Flush() }, false},
+	}
+	for _, test := range tests {
+		txn := memDB.Begin()
+		txn.Get("read")
+		txn.Get("missing")
+		txn.Set("written", "txn")
+		test.other()
+
+		err := txn.Commit()
+		if test.conflict && !errors.Is(err, ErrConflict) {
+			t.Errorf("Expected a conflict after a %s, got %v", test.name, err)
+		} else if !test.conflict && err != nil {
+			t.Errorf("Expected no conflict after a %s, got %v", test.name, err)
+		}
+		if value, _ := memDB.Get("written"); (value == "txn") == test.conflict {
+			t.Errorf("Expected the writes to be applied only without a conflict after a %s, got %q", test.name, value)
+		}
+
+		memDB.Set("read", "old")
+		memDB.Del("missing")
+	}
+}
+
+func TestTxnTransfersWithoutLostUpdates(t *testing.T) {
+	memDB := openTestDB(t, t.TempDir())
+	defer memDB.Close()
+
+	memDB.Set("alice", "100")
+	memDB.Set("bob", "100")
+
+	// Concurrent transfers retry on conflict, and the total stays the same
+	const workers, transfers = 4, 10
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			from, to := "alice", "bob"
+			if w%2 == 1 {
+				from, to = to, from
+			}
+			for i := 0; i < transfers; {
+				txn := memDB.Begin()
+				a, errA := txn.Get(from)
+				b, errB := txn.Get(to)
+				if errA != nil || errB != nil {
+					txn.Rollback()
+					t.Errorf("Error reading balances: %v %v", errA, errB)
+					return
+				}
+				x, _ := strconv.Atoi(a)
+				y, _ := strconv.Atoi(b)
+				txn.Set(from, strconv.Itoa(x-1))
+				txn.Set(to, strconv.Itoa(y+1))
+				if err := txn.Commit(); err == nil {
+					i++
+				} else if !errors.Is(err, ErrConflict) {
+					t.Errorf("Error committing transfer: %v", err)
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	a, _ := memDB.Get("alice")
+	b, _ := memDB.Get("bob")
+	x, _ := strconv.Atoi(a)
+	y, _ := strconv.Atoi(b)
+	if x+y != 200 || x != 100 {
+		t.Errorf("Expected balanced transfers to leave 100 each, got %s and %s", a, b)
+	}
+}